@@ -0,0 +1,566 @@
+// Package ast declares the types used to represent syntax trees for
+// WitcherScript source files.
+package ast
+
+import (
+	"timmy.narnian.us/git/timmy/wsfmt/text/lex"
+)
+
+// NoPos is the position of an optional token that is not present in the
+// source.
+const NoPos lex.Pos = -1
+
+// Node is implemented by every node of the syntax tree.
+type Node interface {
+	Pos() lex.Pos // position of the first byte of the node
+	End() lex.Pos // position of the first byte after the node
+}
+
+// Decl is implemented by all declaration nodes.
+type Decl interface {
+	Node
+	declNode()
+}
+
+// Stmt is implemented by all statement nodes.
+type Stmt interface {
+	Node
+	stmtNode()
+}
+
+// Expr is implemented by all expression and type nodes.
+type Expr interface {
+	Node
+	exprNode()
+}
+
+// File is a parsed WitcherScript source file.
+type File struct {
+	Name     string     // name of the source file
+	Lines    *lex.File  // line table of the source
+	Decls    []Decl     // top-level declarations
+	Comments []*Comment // all comments in source order
+	EOF      lex.Pos    // position of the end of the input
+}
+
+func (f *File) Pos() lex.Pos { return 0 }
+func (f *File) End() lex.Pos { return f.EOF }
+
+// Comment is a single // or /* */ comment.
+type Comment struct {
+	Slash lex.Pos // position of the leading '/'
+	Text  string  // comment text including the comment markers
+}
+
+func (c *Comment) Pos() lex.Pos { return c.Slash }
+func (c *Comment) End() lex.Pos { return c.Slash + lex.Pos(len(c.Text)) }
+
+// Expressions and types.
+type (
+	// Ident is an identifier, or one of the keywords this, super, parent and
+	// virtual_parent, which are used like identifiers.
+	Ident struct {
+		NamePos lex.Pos
+		Name    string
+	}
+
+	// BasicLit is a number, string, name, bool or NULL literal.
+	BasicLit struct {
+		ValuePos lex.Pos
+		Kind     lex.ItemType // lex.ItemNumber, lex.ItemString, lex.ItemName, lex.ItemBool or lex.ItemNULL
+		Value    string       // literal text, including any quotes
+	}
+
+	// ParenExpr is a parenthesized expression.
+	ParenExpr struct {
+		Lparen lex.Pos
+		X      Expr
+		Rparen lex.Pos
+	}
+
+	// SelectorExpr is a member access: X.Sel.
+	SelectorExpr struct {
+		X   Expr
+		Sel *Ident
+	}
+
+	// IndexExpr is an array index: X[Index].
+	IndexExpr struct {
+		X      Expr
+		Lbrack lex.Pos
+		Index  Expr
+		Rbrack lex.Pos
+	}
+
+	// CallExpr is a function call. Skipped optional arguments are nil.
+	CallExpr struct {
+		Fun    Expr
+		Lparen lex.Pos
+		Args   []Expr
+		Commas []lex.Pos // positions of the commas between Args
+		Rparen lex.Pos
+	}
+
+	// UnaryExpr is a prefix operator applied to an operand.
+	UnaryExpr struct {
+		OpPos lex.Pos
+		Op    string
+		X     Expr
+	}
+
+	// IncDecExpr is an increment or decrement: ++X, --X, X++ or X--.
+	IncDecExpr struct {
+		X      Expr
+		TokPos lex.Pos
+		Tok    string // ++ or --
+		Post   bool   // the operator follows X
+	}
+
+	// BinaryExpr is an infix operator applied to two operands.
+	BinaryExpr struct {
+		X     Expr
+		OpPos lex.Pos
+		Op    string
+		Y     Expr
+	}
+
+	// CondExpr is a conditional expression: Cond ? X : Y.
+	CondExpr struct {
+		Cond Expr
+		X    Expr
+		Y    Expr
+	}
+
+	// NewExpr creates an object: new Type [in Owner].
+	NewExpr struct {
+		New   lex.Pos
+		Type  Expr
+		Owner Expr // nil if there is no in clause
+	}
+
+	// CastExpr is a type cast: (Type)X.
+	CastExpr struct {
+		Lparen lex.Pos
+		Type   Expr
+		X      Expr
+	}
+
+	// ArrayType is an array type: array<Elem>.
+	ArrayType struct {
+		Array lex.Pos
+		Elem  Expr
+		Gt    lex.Pos
+	}
+)
+
+func (x *Ident) Pos() lex.Pos        { return x.NamePos }
+func (x *BasicLit) Pos() lex.Pos     { return x.ValuePos }
+func (x *ParenExpr) Pos() lex.Pos    { return x.Lparen }
+func (x *SelectorExpr) Pos() lex.Pos { return x.X.Pos() }
+func (x *IndexExpr) Pos() lex.Pos    { return x.X.Pos() }
+func (x *CallExpr) Pos() lex.Pos     { return x.Fun.Pos() }
+func (x *UnaryExpr) Pos() lex.Pos    { return x.OpPos }
+func (x *BinaryExpr) Pos() lex.Pos   { return x.X.Pos() }
+func (x *CondExpr) Pos() lex.Pos     { return x.Cond.Pos() }
+func (x *NewExpr) Pos() lex.Pos      { return x.New }
+func (x *CastExpr) Pos() lex.Pos     { return x.Lparen }
+func (x *ArrayType) Pos() lex.Pos    { return x.Array }
+func (x *IncDecExpr) Pos() lex.Pos {
+	if x.Post {
+		return x.X.Pos()
+	}
+	return x.TokPos
+}
+
+func (x *Ident) End() lex.Pos        { return x.NamePos + lex.Pos(len(x.Name)) }
+func (x *BasicLit) End() lex.Pos     { return x.ValuePos + lex.Pos(len(x.Value)) }
+func (x *ParenExpr) End() lex.Pos    { return x.Rparen + 1 }
+func (x *SelectorExpr) End() lex.Pos { return x.Sel.End() }
+func (x *IndexExpr) End() lex.Pos    { return x.Rbrack + 1 }
+func (x *CallExpr) End() lex.Pos     { return x.Rparen + 1 }
+func (x *UnaryExpr) End() lex.Pos    { return x.X.End() }
+func (x *BinaryExpr) End() lex.Pos   { return x.Y.End() }
+func (x *CondExpr) End() lex.Pos     { return x.Y.End() }
+func (x *CastExpr) End() lex.Pos     { return x.X.End() }
+func (x *ArrayType) End() lex.Pos    { return x.Gt + 1 }
+func (x *NewExpr) End() lex.Pos {
+	if x.Owner != nil {
+		return x.Owner.End()
+	}
+	return x.Type.End()
+}
+func (x *IncDecExpr) End() lex.Pos {
+	if x.Post {
+		return x.TokPos + 2
+	}
+	return x.X.End()
+}
+
+func (*Ident) exprNode()        {}
+func (*BasicLit) exprNode()     {}
+func (*ParenExpr) exprNode()    {}
+func (*SelectorExpr) exprNode() {}
+func (*IndexExpr) exprNode()    {}
+func (*CallExpr) exprNode()     {}
+func (*UnaryExpr) exprNode()    {}
+func (*IncDecExpr) exprNode()   {}
+func (*BinaryExpr) exprNode()   {}
+func (*CondExpr) exprNode()     {}
+func (*NewExpr) exprNode()      {}
+func (*CastExpr) exprNode()     {}
+func (*ArrayType) exprNode()    {}
+
+// Statements.
+type (
+	// BlockStmt is a braced statement list.
+	BlockStmt struct {
+		Lbrace lex.Pos
+		List   []Stmt
+		Rbrace lex.Pos
+	}
+
+	// ExprStmt is an expression evaluated for its side effects.
+	ExprStmt struct {
+		X    Expr
+		Semi lex.Pos // NoPos inside a for clause
+	}
+
+	// AssignStmt is an assignment or compound assignment.
+	AssignStmt struct {
+		Lhs    Expr
+		TokPos lex.Pos
+		Tok    string // =, +=, -=, *=, /=, &= or |=
+		Rhs    Expr
+		Semi   lex.Pos // NoPos inside a for clause
+	}
+
+	// DeclStmt is a variable declaration inside a function body.
+	DeclStmt struct {
+		Decl *VarDecl
+	}
+
+	// EmptyStmt is a lone semicolon.
+	EmptyStmt struct {
+		Semi lex.Pos
+	}
+
+	// IfStmt is an if statement with an optional else branch.
+	IfStmt struct {
+		If      lex.Pos
+		Cond    Expr
+		Body    Stmt
+		ElsePos lex.Pos // NoPos if there is no else branch
+		Else    Stmt    // nil, *IfStmt, *BlockStmt or any other statement
+	}
+
+	// WhileStmt is a while loop.
+	WhileStmt struct {
+		While lex.Pos
+		Cond  Expr
+		Body  Stmt
+	}
+
+	// DoWhileStmt is a do ... while loop.
+	DoWhileStmt struct {
+		Do    lex.Pos
+		Body  Stmt
+		While lex.Pos
+		Cond  Expr
+		Semi  lex.Pos
+	}
+
+	// ForStmt is a for loop. Any of Init, Cond and Post may be nil.
+	ForStmt struct {
+		For  lex.Pos
+		Init Stmt
+		Cond Expr
+		Post Stmt
+		Body Stmt
+	}
+
+	// SwitchStmt is a switch statement.
+	SwitchStmt struct {
+		Switch lex.Pos
+		Tag    Expr
+		Lbrace lex.Pos
+		Body   []*CaseClause
+		Rbrace lex.Pos
+	}
+
+	// CaseClause is a case or default label and the statements under it.
+	CaseClause struct {
+		Case  lex.Pos
+		Value Expr // nil for default
+		Colon lex.Pos
+		Body  []Stmt
+	}
+
+	// ReturnStmt is a return statement.
+	ReturnStmt struct {
+		Return lex.Pos
+		Result Expr // nil for a bare return
+		Semi   lex.Pos
+	}
+
+	// BranchStmt is a break or continue statement.
+	BranchStmt struct {
+		TokPos lex.Pos
+		Tok    lex.ItemType // lex.ItemBreak or lex.ItemContinue
+		Semi   lex.Pos
+	}
+
+	// DeleteStmt destroys an object.
+	DeleteStmt struct {
+		Delete lex.Pos
+		X      Expr
+		Semi   lex.Pos
+	}
+)
+
+func (s *BlockStmt) Pos() lex.Pos   { return s.Lbrace }
+func (s *ExprStmt) Pos() lex.Pos    { return s.X.Pos() }
+func (s *AssignStmt) Pos() lex.Pos  { return s.Lhs.Pos() }
+func (s *DeclStmt) Pos() lex.Pos    { return s.Decl.Pos() }
+func (s *EmptyStmt) Pos() lex.Pos   { return s.Semi }
+func (s *IfStmt) Pos() lex.Pos      { return s.If }
+func (s *WhileStmt) Pos() lex.Pos   { return s.While }
+func (s *DoWhileStmt) Pos() lex.Pos { return s.Do }
+func (s *ForStmt) Pos() lex.Pos     { return s.For }
+func (s *SwitchStmt) Pos() lex.Pos  { return s.Switch }
+func (s *CaseClause) Pos() lex.Pos  { return s.Case }
+func (s *ReturnStmt) Pos() lex.Pos  { return s.Return }
+func (s *BranchStmt) Pos() lex.Pos  { return s.TokPos }
+func (s *DeleteStmt) Pos() lex.Pos  { return s.Delete }
+
+func (s *BlockStmt) End() lex.Pos   { return s.Rbrace + 1 }
+func (s *ExprStmt) End() lex.Pos    { return semiEnd(s.Semi, s.X) }
+func (s *AssignStmt) End() lex.Pos  { return semiEnd(s.Semi, s.Rhs) }
+func (s *DeclStmt) End() lex.Pos    { return s.Decl.End() }
+func (s *EmptyStmt) End() lex.Pos   { return s.Semi + 1 }
+func (s *WhileStmt) End() lex.Pos   { return s.Body.End() }
+func (s *DoWhileStmt) End() lex.Pos { return s.Semi + 1 }
+func (s *ForStmt) End() lex.Pos     { return s.Body.End() }
+func (s *SwitchStmt) End() lex.Pos  { return s.Rbrace + 1 }
+func (s *ReturnStmt) End() lex.Pos  { return s.Semi + 1 }
+func (s *BranchStmt) End() lex.Pos  { return s.Semi + 1 }
+func (s *DeleteStmt) End() lex.Pos  { return s.Semi + 1 }
+func (s *IfStmt) End() lex.Pos {
+	if s.Else != nil {
+		return s.Else.End()
+	}
+	return s.Body.End()
+}
+func (s *CaseClause) End() lex.Pos {
+	if n := len(s.Body); n > 0 {
+		return s.Body[n-1].End()
+	}
+	return s.Colon + 1
+}
+
+func (*BlockStmt) stmtNode()   {}
+func (*ExprStmt) stmtNode()    {}
+func (*AssignStmt) stmtNode()  {}
+func (*DeclStmt) stmtNode()    {}
+func (*EmptyStmt) stmtNode()   {}
+func (*IfStmt) stmtNode()      {}
+func (*WhileStmt) stmtNode()   {}
+func (*DoWhileStmt) stmtNode() {}
+func (*ForStmt) stmtNode()     {}
+func (*SwitchStmt) stmtNode()  {}
+func (*CaseClause) stmtNode()  {}
+func (*ReturnStmt) stmtNode()  {}
+func (*BranchStmt) stmtNode()  {}
+func (*DeleteStmt) stmtNode()  {}
+
+// semiEnd returns the end of a statement that may or may not have a
+// terminating semicolon.
+func semiEnd(semi lex.Pos, last Node) lex.Pos {
+	if semi != NoPos {
+		return semi + 1
+	}
+	return last.End()
+}
+
+// Declarations.
+type (
+	// Field is a group of parameters or variables sharing a type:
+	// [modifiers] a, b : Type
+	Field struct {
+		Mods  []*Ident
+		Names []*Ident
+		Type  Expr
+	}
+
+	// VarDecl declares variables: [modifiers] var a, b : Type [= Value];
+	VarDecl struct {
+		Mods  []*Ident
+		Var   lex.Pos
+		Names []*Ident
+		Type  Expr
+		Value Expr // nil if there is no initializer
+		Semi  lex.Pos
+	}
+
+	// FuncDecl declares a function or event. Body is nil for declarations
+	// terminated by a semicolon.
+	FuncDecl struct {
+		Mods   []*Ident
+		Func   lex.Pos
+		Kind   lex.ItemType // lex.ItemFunction or lex.ItemEvent
+		Name   *Ident
+		Params []*Field
+		Rparen lex.Pos
+		Result Expr // nil if there is no return type
+		Body   *BlockStmt
+		Semi   lex.Pos // NoPos if Body is present
+	}
+
+	// ClassDecl declares a class: [modifiers] class Name [extends Base] { ... }
+	ClassDecl struct {
+		Mods    []*Ident
+		Class   lex.Pos
+		Name    *Ident
+		Extends *Ident // nil if there is no base class
+		Lbrace  lex.Pos
+		Members []Decl
+		Rbrace  lex.Pos
+	}
+
+	// StateDecl declares a state: [modifiers] state Name in Class [extends Base] { ... }
+	StateDecl struct {
+		Mods    []*Ident
+		State   lex.Pos
+		Name    *Ident
+		In      *Ident
+		Extends *Ident // nil if there is no base state
+		Lbrace  lex.Pos
+		Members []Decl
+		Rbrace  lex.Pos
+	}
+
+	// StructDecl declares a struct: [modifiers] struct Name { ... }
+	StructDecl struct {
+		Mods    []*Ident
+		Struct  lex.Pos
+		Name    *Ident
+		Lbrace  lex.Pos
+		Members []Decl
+		Rbrace  lex.Pos
+	}
+
+	// EnumDecl declares an enum: enum Name { A [= 1], ... }
+	EnumDecl struct {
+		Enum   lex.Pos
+		Name   *Ident
+		Lbrace lex.Pos
+		Values []*EnumValue
+		Rbrace lex.Pos
+	}
+
+	// EnumValue is a single enum constant.
+	EnumValue struct {
+		Name  *Ident
+		Value Expr    // nil if the value is implicit
+		Comma lex.Pos // NoPos if not followed by a comma
+	}
+
+	// DefaultDecl sets the default value of a member: default Name = Value;
+	DefaultDecl struct {
+		Default lex.Pos
+		Name    Expr
+		Value   Expr
+		Semi    lex.Pos
+	}
+
+	// DefaultsDecl is a block of default values: defaults { Name = Value; ... }
+	DefaultsDecl struct {
+		Defaults lex.Pos
+		Body     *BlockStmt
+	}
+
+	// HintDecl documents a member for the editor: hint Name = "text";
+	HintDecl struct {
+		Hint  lex.Pos
+		Name  *Ident
+		Value Expr
+		Semi  lex.Pos
+	}
+
+	// AutobindDecl binds a component to a member:
+	// [modifiers] autobind Name : Type = Value;
+	AutobindDecl struct {
+		Mods     []*Ident
+		Autobind lex.Pos
+		Name     *Ident
+		Type     Expr
+		Value    Expr // a string or the keyword single
+		Semi     lex.Pos
+	}
+
+	// EmptyDecl is a stray semicolon between declarations.
+	EmptyDecl struct {
+		Semi lex.Pos
+	}
+)
+
+func (d *Field) Pos() lex.Pos        { return modsPos(d.Mods, d.Names[0].Pos()) }
+func (d *VarDecl) Pos() lex.Pos      { return modsPos(d.Mods, d.Var) }
+func (d *FuncDecl) Pos() lex.Pos     { return modsPos(d.Mods, d.Func) }
+func (d *ClassDecl) Pos() lex.Pos    { return modsPos(d.Mods, d.Class) }
+func (d *StateDecl) Pos() lex.Pos    { return modsPos(d.Mods, d.State) }
+func (d *StructDecl) Pos() lex.Pos   { return modsPos(d.Mods, d.Struct) }
+func (d *EnumDecl) Pos() lex.Pos     { return d.Enum }
+func (d *EnumValue) Pos() lex.Pos    { return d.Name.Pos() }
+func (d *DefaultDecl) Pos() lex.Pos  { return d.Default }
+func (d *DefaultsDecl) Pos() lex.Pos { return d.Defaults }
+func (d *HintDecl) Pos() lex.Pos     { return d.Hint }
+func (d *AutobindDecl) Pos() lex.Pos { return modsPos(d.Mods, d.Autobind) }
+func (d *EmptyDecl) Pos() lex.Pos    { return d.Semi }
+
+func (d *Field) End() lex.Pos        { return d.Type.End() }
+func (d *VarDecl) End() lex.Pos      { return d.Semi + 1 }
+func (d *ClassDecl) End() lex.Pos    { return d.Rbrace + 1 }
+func (d *StateDecl) End() lex.Pos    { return d.Rbrace + 1 }
+func (d *StructDecl) End() lex.Pos   { return d.Rbrace + 1 }
+func (d *EnumDecl) End() lex.Pos     { return d.Rbrace + 1 }
+func (d *DefaultDecl) End() lex.Pos  { return d.Semi + 1 }
+func (d *DefaultsDecl) End() lex.Pos { return d.Body.End() }
+func (d *HintDecl) End() lex.Pos     { return d.Semi + 1 }
+func (d *AutobindDecl) End() lex.Pos { return d.Semi + 1 }
+func (d *EmptyDecl) End() lex.Pos    { return d.Semi + 1 }
+func (d *FuncDecl) End() lex.Pos {
+	if d.Body != nil {
+		return d.Body.End()
+	}
+	return d.Semi + 1
+}
+func (d *EnumValue) End() lex.Pos {
+	if d.Comma != NoPos {
+		return d.Comma + 1
+	}
+	if d.Value != nil {
+		return d.Value.End()
+	}
+	return d.Name.End()
+}
+
+func (*VarDecl) declNode()      {}
+func (*FuncDecl) declNode()     {}
+func (*ClassDecl) declNode()    {}
+func (*StateDecl) declNode()    {}
+func (*StructDecl) declNode()   {}
+func (*EnumDecl) declNode()     {}
+func (*DefaultDecl) declNode()  {}
+func (*DefaultsDecl) declNode() {}
+func (*HintDecl) declNode()     {}
+func (*AutobindDecl) declNode() {}
+func (*EmptyDecl) declNode()    {}
+
+// modsPos returns the position of the first modifier, or pos if there are
+// none.
+func modsPos(mods []*Ident, pos lex.Pos) lex.Pos {
+	if len(mods) > 0 {
+		return mods[0].Pos()
+	}
+	return pos
+}
@@ -0,0 +1,225 @@
+// Package config reads wsfmt settings from .wsfmt.toml files.
+//
+// The settings for a file come from every configuration file in its
+// directory and the directories above it, up to the file system root or
+// the first file that sets root = true. Files closer to the formatted file
+// override the settings of those further up, so a subdirectory can carry
+// its own overrides.
+package config
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+
+	"timmy.narnian.us/git/timmy/wsfmt/format"
+)
+
+// FileName is the name of a configuration file.
+const FileName = ".wsfmt.toml"
+
+// Config is the contents of a configuration file. Settings left out of the
+// file are nil and leave the corresponding option unchanged.
+type Config struct {
+	Root        bool        `toml:"root"`         // do not look for configuration files further up
+	MaxNewlines *int        `toml:"max_newlines"` // maximum number of consecutive newlines kept
+	Indent      *Indent     `toml:"indent"`       // "tab" or a number of spaces
+	BraceStyle  *BraceStyle `toml:"brace_style"`  // "same-line" or "next-line"
+	Width       *int        `toml:"width"`        // maximum line width; 0 means no limit
+	AST         *bool       `toml:"ast"`          // format by printing the syntax tree
+
+	// Exclude lists glob patterns of files that are not formatted, relative
+	// to the directory of the configuration file. A pattern without a slash,
+	// other than a trailing one, matches a file or directory name at any
+	// depth; a pattern that matches a directory excludes everything below
+	// it, so dir and dir/** are the same.
+	Exclude []string `toml:"exclude"`
+
+	path string // file the configuration was read from
+}
+
+// Indent is a format.Indent that can be written in TOML as "tab" or as a
+// number of spaces.
+type Indent struct {
+	format.Indent
+}
+
+// UnmarshalTOML implements toml.Unmarshaler.
+func (i *Indent) UnmarshalTOML(v interface{}) error {
+	switch v := v.(type) {
+	case string:
+		return i.Set(v)
+	case int64:
+		return i.Set(fmt.Sprint(v))
+	}
+	return fmt.Errorf("invalid indentation %v: want \"tab\" or a number of spaces", v)
+}
+
+// BraceStyle is a format.BraceStyle written in TOML by name.
+type BraceStyle struct {
+	format.BraceStyle
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (b *BraceStyle) UnmarshalText(text []byte) error {
+	return b.Set(string(text))
+}
+
+// Load reads the configuration file name.
+func Load(name string) (*Config, error) {
+	c := Config{path: name}
+	md, err := toml.DecodeFile(name, &c)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, len(undecoded))
+		for i, k := range undecoded {
+			keys[i] = k.String()
+		}
+		return nil, fmt.Errorf("%s: unknown settings: %s", name, strings.Join(keys, ", "))
+	}
+	if c.MaxNewlines != nil && *c.MaxNewlines < 1 {
+		return nil, fmt.Errorf("%s: max_newlines must be at least 1", name)
+	}
+	if c.Width != nil && *c.Width < 0 {
+		return nil, fmt.Errorf("%s: width must not be negative", name)
+	}
+	for _, pattern := range c.Exclude {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("%s: exclude %q: %v", name, pattern, err)
+		}
+	}
+	return &c, nil
+}
+
+// Apply sets the options that c configures.
+func (c *Config) Apply(opts *format.Options) {
+	if c.MaxNewlines != nil {
+		opts.MaxNewlines = *c.MaxNewlines
+	}
+	if c.Indent != nil {
+		opts.Indent = c.Indent.Indent
+	}
+	if c.BraceStyle != nil {
+		opts.BraceStyle = c.BraceStyle.BraceStyle
+	}
+	if c.Width != nil {
+		opts.Width = *c.Width
+	}
+	if c.AST != nil {
+		opts.AST = *c.AST
+	}
+}
+
+// Path returns the file c was read from.
+func (c *Config) Path() string {
+	return c.path
+}
+
+// excludes reports the pattern of c that excludes name, a slash-separated
+// path relative to the directory of c.
+func (c *Config) excludes(name string) (pattern string, ok bool) {
+	elems := strings.Split(name, "/")
+	for _, pattern := range c.Exclude {
+		p := strings.TrimSuffix(strings.TrimSuffix(pattern, "/**"), "/")
+		if !strings.Contains(strings.TrimSuffix(pattern, "/"), "/") {
+			for _, elem := range elems {
+				if ok, _ := path.Match(p, elem); ok {
+					return pattern, true
+				}
+			}
+			continue
+		}
+		for i := range elems {
+			if ok, _ := path.Match(p, strings.Join(elems[:i+1], "/")); ok {
+				return pattern, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Settings are the effective settings for a file.
+type Settings struct {
+	Options  format.Options
+	Configs  []*Config // configuration files that apply, outermost first
+	Excluded *Config   // the configuration that excludes the file, if any
+	Pattern  string    // the exclude pattern of Excluded that matched
+}
+
+// A Loader finds and caches configuration files. The zero value is ready
+// to use.
+type Loader struct {
+	dirs map[string]*Config // configuration file of each directory; nil if none
+}
+
+// Resolve returns the settings for the file or directory at name, starting
+// from opts. name need not exist. The configuration file of a directory
+// applies to the directory itself.
+func (l *Loader) Resolve(name string, opts format.Options) (*Settings, error) {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(abs)
+	if fi, err := os.Stat(abs); err == nil && fi.IsDir() {
+		dir = abs
+	}
+	var configs []*Config
+	for {
+		c, err := l.load(dir)
+		if err != nil {
+			return nil, err
+		}
+		if c != nil {
+			configs = append(configs, c)
+			if c.Root {
+				break
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+
+	s := &Settings{Options: opts}
+	for i := len(configs) - 1; i >= 0; i-- {
+		c := configs[i]
+		s.Configs = append(s.Configs, c)
+		c.Apply(&s.Options)
+		rel, err := filepath.Rel(filepath.Dir(c.path), abs)
+		if err != nil || s.Excluded != nil {
+			continue
+		}
+		if pattern, ok := c.excludes(filepath.ToSlash(rel)); ok {
+			s.Excluded, s.Pattern = c, pattern
+		}
+	}
+	return s, nil
+}
+
+// load returns the configuration file in dir, or nil if there is none.
+func (l *Loader) load(dir string) (*Config, error) {
+	if c, ok := l.dirs[dir]; ok {
+		return c, nil
+	}
+	if l.dirs == nil {
+		l.dirs = make(map[string]*Config)
+	}
+	name := filepath.Join(dir, FileName)
+	var c *Config
+	if _, err := os.Stat(name); err == nil {
+		if c, err = Load(name); err != nil {
+			return nil, err
+		}
+	}
+	l.dirs[dir] = c
+	return c, nil
+}
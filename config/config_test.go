@@ -0,0 +1,105 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"timmy.narnian.us/git/timmy/wsfmt/format"
+)
+
+// tree is the layout TestResolve works in: configuration files by the
+// slash-separated directory holding them, and the directories made.
+var tree = map[string]string{
+	// above the root, never read
+	".": `brace_style = "next-line"`,
+	"proj": `root = true
+indent = 4
+max_newlines = 2
+exclude = ["gen", "tmp/", "vendor/**", "build/out/*.ws"]`,
+	"proj/sub": `indent = "tab"
+width = 80
+exclude = ["skip.ws"]`,
+	"proj/sub/inner": `root = true
+width = 100`,
+	"proj/build/out":  "",
+	"proj/vendor/lib": "",
+	"proj/a/gen":      "",
+}
+
+func TestResolve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wsfmt-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for d, text := range tree {
+		d = filepath.Join(dir, filepath.FromSlash(d))
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if text == "" {
+			continue
+		}
+		if err := ioutil.WriteFile(filepath.Join(d, FileName), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string // file or directory, relative to dir
+		configs int    // number of configuration files that apply
+		indent  int    // spaces; 0 is a tab
+		width   int
+		newline int    // max_newlines
+		pattern string // exclude pattern that matches, if any
+	}{
+		// walk-up stops at root = true
+		{name: "proj/a.ws", configs: 1, indent: 4, newline: 2},
+		// closer files override those further up
+		{name: "proj/sub/a.ws", configs: 2, width: 80, newline: 2},
+		{name: "proj/sub/deep/a.ws", configs: 2, width: 80, newline: 2},
+		{name: "proj/sub/inner/a.ws", configs: 1, width: 100},
+		// a directory's own configuration applies to it
+		{name: "proj/sub", configs: 2, width: 80, newline: 2},
+		{name: "proj/sub/inner", configs: 1, width: 100},
+		// excludes
+		{name: "proj/sub/skip.ws", configs: 2, width: 80, newline: 2, pattern: "skip.ws"},
+		{name: "proj/sub/deep/skip.ws", configs: 2, width: 80, newline: 2, pattern: "skip.ws"},
+		{name: "proj/gen/a.ws", configs: 1, indent: 4, newline: 2, pattern: "gen"},
+		{name: "proj/a/gen/b.ws", configs: 1, indent: 4, newline: 2, pattern: "gen"},
+		{name: "proj/a/gen", configs: 1, indent: 4, newline: 2, pattern: "gen"},
+		{name: "proj/a/generated.ws", configs: 1, indent: 4, newline: 2},
+		{name: "proj/vendor", configs: 1, indent: 4, newline: 2, pattern: "vendor/**"},
+		{name: "proj/vendor/lib/a.ws", configs: 1, indent: 4, newline: 2, pattern: "vendor/**"},
+		{name: "proj/a/vendor/a.ws", configs: 1, indent: 4, newline: 2},
+		{name: "proj/a/tmp/a.ws", configs: 1, indent: 4, newline: 2, pattern: "tmp/"},
+		{name: "proj/build/out/a.ws", configs: 1, indent: 4, newline: 2, pattern: "build/out/*.ws"},
+		{name: "proj/build/a.ws", configs: 1, indent: 4, newline: 2},
+	}
+	var l Loader
+	for _, test := range tests {
+		s, err := l.Resolve(filepath.Join(dir, filepath.FromSlash(test.name)), format.Options{})
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if len(s.Configs) != test.configs {
+			t.Errorf("%s: %d configuration files, want %d", test.name, len(s.Configs), test.configs)
+		}
+		if s.Options.Indent.Spaces != test.indent || s.Options.Width != test.width {
+			t.Errorf("%s: indent %d, width %d, want %d, %d", test.name,
+				s.Options.Indent.Spaces, s.Options.Width, test.indent, test.width)
+		}
+		if s.Options.BraceStyle != format.SameLine {
+			t.Errorf("%s: brace style %v from above the root", test.name, s.Options.BraceStyle)
+		}
+		if s.Options.MaxNewlines != test.newline {
+			t.Errorf("%s: max_newlines %d, want %d", test.name, s.Options.MaxNewlines, test.newline)
+		}
+		if s.Pattern != test.pattern || (s.Excluded == nil) != (test.pattern == "") {
+			t.Errorf("%s: excluded by %q, want %q", test.name, s.Pattern, test.pattern)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+// Package diff computes shortest edit scripts between two sequences and
+// prints them as unified diffs.
+package diff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Op is the kind of an edit.
+type Op int
+
+const (
+	Equal  Op = iota // A and B are the same element
+	Delete           // A is removed
+	Insert           // B is added
+)
+
+// Edit is a single step of an edit script. A is an index into the first
+// sequence and B an index into the second; for Delete only A is meaningful
+// and for Insert only B, but both always hold the position reached in
+// their sequence.
+type Edit struct {
+	Op   Op
+	A, B int
+}
+
+// Diff returns a shortest edit script turning a sequence of n elements into
+// one of m elements, using the linear space variant of Myers' algorithm.
+// eq reports whether element i of the first sequence equals element j of
+// the second. Within a run of changes, deletions come before insertions.
+func Diff(n, m int, eq func(i, j int) bool) []Edit {
+	d := &differ{
+		eq:  eq,
+		off: n + m + 1,
+		vf:  make([]int, 2*(n+m)+3),
+		vb:  make([]int, 2*(n+m)+3),
+	}
+	d.compare(0, n, 0, m)
+	return deletesFirst(d.edits)
+}
+
+// differ holds the state of a Diff. vf and vb hold the furthest x reached
+// on each diagonal by the forward and the backward search, offset by off.
+type differ struct {
+	eq     func(i, j int) bool
+	off    int
+	vf, vb []int
+	edits  []Edit
+}
+
+// compare appends the edits turning a[a0:a1] into b[b0:b1]. It splits the
+// problem at the middle snake of a shortest path and recurses on both
+// halves.
+func (d *differ) compare(a0, a1, b0, b1 int) {
+	for a0 < a1 && b0 < b1 && d.eq(a0, b0) {
+		d.edits = append(d.edits, Edit{Equal, a0, b0})
+		a0++
+		b0++
+	}
+	suffix := 0
+	for a1 > a0 && b1 > b0 && d.eq(a1-1, b1-1) {
+		a1--
+		b1--
+		suffix++
+	}
+	switch {
+	case a0 == a1:
+		for y := b0; y < b1; y++ {
+			d.edits = append(d.edits, Edit{Insert, a0, y})
+		}
+	case b0 == b1:
+		for x := a0; x < a1; x++ {
+			d.edits = append(d.edits, Edit{Delete, x, b0})
+		}
+	default:
+		x, y, u, v := d.middleSnake(a0, a1, b0, b1)
+		d.compare(a0, x, b0, y)
+		for ; x < u; x, y = x+1, y+1 {
+			d.edits = append(d.edits, Edit{Equal, x, y})
+		}
+		d.compare(u, a1, v, b1)
+	}
+	for i := 0; i < suffix; i++ {
+		d.edits = append(d.edits, Edit{Equal, a1 + i, b1 + i})
+	}
+}
+
+// middleSnake returns the start (x, y) and end (u, v) of the snake in the
+// middle of a shortest path from (a0, b0) to (a1, b1), searching forward
+// from the start and backward from the end at once until they overlap.
+// a[a0:a1] and b[b0:b1] must be non-empty and differ in their first and
+// in their last elements, so that both halves are smaller problems.
+func (d *differ) middleSnake(a0, a1, b0, b1 int) (x, y, u, v int) {
+	var (
+		n, m  = a1 - a0, b1 - b0
+		delta = n - m
+		odd   = delta&1 != 0
+		vf    = d.vf
+		vb    = d.vb
+		off   = d.off
+	)
+	vf[off+1], vb[off+1] = 0, 0
+	for D := 0; D <= (n+m+1)/2; D++ {
+		for k := -D; k <= D; k += 2 {
+			var x int
+			if k == -D || k != D && vf[off+k-1] < vf[off+k+1] {
+				x = vf[off+k+1]
+			} else {
+				x = vf[off+k-1] + 1
+			}
+			y := x - k
+			sx, sy := x, y
+			for x < n && y < m && d.eq(a0+x, b0+y) {
+				x++
+				y++
+			}
+			vf[off+k] = x
+			if kr := delta - k; odd && kr >= -(D-1) && kr <= D-1 && x+vb[off+kr] >= n {
+				return a0 + sx, b0 + sy, a0 + x, b0 + y
+			}
+		}
+		for k := -D; k <= D; k += 2 {
+			var x int
+			if k == -D || k != D && vb[off+k-1] < vb[off+k+1] {
+				x = vb[off+k+1]
+			} else {
+				x = vb[off+k-1] + 1
+			}
+			y := x - k
+			sx, sy := x, y
+			for x < n && y < m && d.eq(a1-x-1, b1-y-1) {
+				x++
+				y++
+			}
+			vb[off+k] = x
+			if kf := delta - k; !odd && kf >= -D && kf <= D && x+vf[off+kf] >= n {
+				return a1 - x, b1 - y, a1 - sx, b1 - sy
+			}
+		}
+	}
+	panic("diff: no middle snake")
+}
+
+// deletesFirst reorders each run of changes in edits so that its
+// deletions come before its insertions.
+func deletesFirst(edits []Edit) []Edit {
+	for i := 0; i < len(edits); {
+		if edits[i].Op == Equal {
+			i++
+			continue
+		}
+		a, b := edits[i].A, edits[i].B
+		j, dels := i, 0
+		for ; j < len(edits) && edits[j].Op != Equal; j++ {
+			if edits[j].Op == Delete {
+				dels++
+			}
+		}
+		for k := i; k < j; k++ {
+			if k-i < dels {
+				edits[k] = Edit{Delete, a + k - i, b}
+			} else {
+				edits[k] = Edit{Insert, a + dels, b + k - i - dels}
+			}
+		}
+		i = j
+	}
+	return edits
+}
+
+// Hunk is a run of edits containing at least one change, surrounded by up
+// to the requested number of unchanged elements.
+type Hunk struct {
+	Edits []Edit
+}
+
+// Hunks groups edits into hunks with context unchanged elements on each
+// side. Changes separated by no more than 2*context unchanged elements
+// share a hunk.
+func Hunks(edits []Edit, context int) []Hunk {
+	var (
+		hunks []Hunk
+		start = -1 // first edit of the current hunk
+		last  = -1 // last change of the current hunk
+	)
+	for i, e := range edits {
+		if e.Op == Equal {
+			continue
+		}
+		switch {
+		case start < 0:
+			start = i - context
+		case i-last-1 > 2*context:
+			hunks = append(hunks, Hunk{edits[start : last+context+1]})
+			start = i - context
+		}
+		if start < 0 {
+			start = 0
+		}
+		last = i
+	}
+	if start >= 0 {
+		end := last + context + 1
+		if end > len(edits) {
+			end = len(edits)
+		}
+		hunks = append(hunks, Hunk{edits[start:end]})
+	}
+	return hunks
+}
+
+// Ranges returns the starting indices and lengths of h in the first and
+// second sequence.
+func (h Hunk) Ranges() (a, aLen, b, bLen int) {
+	a, b = h.Edits[0].A, h.Edits[0].B
+	for _, e := range h.Edits {
+		if e.Op != Insert {
+			aLen++
+		}
+		if e.Op != Delete {
+			bLen++
+		}
+	}
+	return a, aLen, b, bLen
+}
+
+// Lines splits text into lines, without their line terminators. A final
+// line terminator does not start another line.
+func Lines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	for i, line := range lines {
+		lines[i] = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+	}
+	return lines
+}
+
+// Unified returns the unified diff of a and b, with context lines around
+// each change. It returns "" if a and b are equal.
+func Unified(aName, bName, a, b string, context int) string {
+	var (
+		aLines = Lines(a)
+		bLines = Lines(b)
+		hunks  = Hunks(Diff(len(aLines), len(bLines), func(i, j int) bool {
+			return aLines[i] == bLines[j]
+		}), context)
+		out strings.Builder
+	)
+	if len(hunks) == 0 {
+		return ""
+	}
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", aName, bName)
+	for _, h := range hunks {
+		aStart, aLen, bStart, bLen := h.Ranges()
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(aStart, aLen), hunkRange(bStart, bLen))
+		for _, e := range h.Edits {
+			switch e.Op {
+			case Equal:
+				out.WriteString(" " + aLines[e.A] + "\n")
+			case Delete:
+				out.WriteString("-" + aLines[e.A] + "\n")
+			case Insert:
+				out.WriteString("+" + bLines[e.B] + "\n")
+			}
+		}
+	}
+	return out.String()
+}
+
+// hunkRange formats the 0-based start and length of a hunk the way diff -u
+// does.
+func hunkRange(start, n int) string {
+	switch n {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, n)
+}
@@ -0,0 +1,93 @@
+package diff
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// lcs returns the length of the longest common subsequence of a and b.
+func lcs(a, b []int) int {
+	t := make([][]int, len(a)+1)
+	for i := range t {
+		t[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				t[i][j] = t[i+1][j+1] + 1
+			case t[i+1][j] > t[i][j+1]:
+				t[i][j] = t[i+1][j]
+			default:
+				t[i][j] = t[i][j+1]
+			}
+		}
+	}
+	return t[0][0]
+}
+
+// TestDiff checks on random sequences that Diff returns a valid edit
+// script of minimal length with deletions before insertions.
+func TestDiff(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for iter := 0; iter < 20000; iter++ {
+		a, b := make([]int, r.Intn(16)), make([]int, r.Intn(16))
+		k := 1 + r.Intn(4)
+		for i := range a {
+			a[i] = r.Intn(k)
+		}
+		for i := range b {
+			b[i] = r.Intn(k)
+		}
+		edits := Diff(len(a), len(b), func(i, j int) bool { return a[i] == b[j] })
+
+		x, y, equal := 0, 0, 0
+		for i, e := range edits {
+			if e.A != x || e.B != y {
+				t.Fatalf("%v -> %v: edit %d is %+v at %d,%d", a, b, i, e, x, y)
+			}
+			switch e.Op {
+			case Equal:
+				if a[x] != b[y] {
+					t.Fatalf("%v -> %v: edit %d keeps %d as %d", a, b, i, a[x], b[y])
+				}
+				x, y, equal = x+1, y+1, equal+1
+			case Delete:
+				if i > 0 && edits[i-1].Op == Insert {
+					t.Fatalf("%v -> %v: edit %d deletes after an insertion", a, b, i)
+				}
+				x++
+			case Insert:
+				y++
+			}
+		}
+		if x != len(a) || y != len(b) {
+			t.Fatalf("%v -> %v: script ends at %d,%d", a, b, x, y)
+		}
+		if want := lcs(a, b); equal != want {
+			t.Fatalf("%v -> %v: script keeps %d elements, want %d", a, b, equal, want)
+		}
+	}
+}
+
+func TestUnified(t *testing.T) {
+	a := "a\nb\nc\nd\ne\nf\ng\nh\n"
+	b := "a\nB\nc\nd\ne\nf\ng\n"
+	want := `--- a
++++ b
+@@ -1,3 +1,3 @@
+ a
+-b
++B
+ c
+@@ -7,2 +7 @@
+ g
+-h
+`
+	if got := Unified("a", "b", a, b, 1); got != want {
+		t.Errorf("Unified =\n%s\nwant\n%s", got, want)
+	}
+	if got := Unified("a", "b", a, a, 3); got != "" {
+		t.Errorf("Unified of equal texts = %q, want \"\"", got)
+	}
+}
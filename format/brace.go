@@ -0,0 +1,46 @@
+package format
+
+import (
+	"fmt"
+	"strings"
+)
+
+// BraceStyle is the placement of opening braces.
+type BraceStyle int
+
+const (
+	SameLine BraceStyle = iota // at the end of the line that opens the block
+	NextLine                   // on a line of its own
+)
+
+var braceStyleNames = map[BraceStyle]string{
+	SameLine: "same-line",
+	NextLine: "next-line",
+}
+
+func (b BraceStyle) String() string {
+	if name, ok := braceStyleNames[b]; ok {
+		return name
+	}
+	return fmt.Sprintf("BraceStyle(%d)", int(b))
+}
+
+// ParseBraceStyle returns the brace style named s: same-line or next-line.
+func ParseBraceStyle(s string) (BraceStyle, error) {
+	for b, name := range braceStyleNames {
+		if strings.EqualFold(name, s) {
+			return b, nil
+		}
+	}
+	return SameLine, fmt.Errorf("unknown brace style %q", s)
+}
+
+// Set implements flag.Value.
+func (b *BraceStyle) Set(s string) error {
+	v, err := ParseBraceStyle(s)
+	if err != nil {
+		return err
+	}
+	*b = v
+	return nil
+}
@@ -0,0 +1,253 @@
+package format
+
+import (
+	"fmt"
+	"strings"
+
+	"timmy.narnian.us/git/timmy/wsfmt/text/lex"
+)
+
+// The token formatter skips comments. placeComments puts them back into
+// its output between the same two tokens they were found between, keeping
+// their placement in the source:
+//
+//	a = 1; // trailing: stays at the end of the line of the token before it
+//	// leading: stays on a line of its own, indented like the next line
+//	Foo(a, /* inline */ b);
+//
+// A // comment that ends up in the middle of a line breaks the line, and
+// the rest of the line is indented as a continuation, except after a
+// closing brace, where else stays at the indentation of the brace.
+
+// comment is a comment of the source.
+type comment struct {
+	text         string
+	before       int  // index of the token that follows the comment
+	ownLine      bool // only space precedes the comment on its line
+	newlineAfter bool // only space follows the comment on its line
+	blankAfter   int  // empty lines after the comment
+}
+
+func (c comment) isLine() bool {
+	return strings.HasPrefix(c.text, "//")
+}
+
+// collectComments returns the comments of text and the number of tokens
+// around them.
+func collectComments(name, text string) (comments []comment, tokens int) {
+	l := lex.Lex(name, text)
+	defer l.Close()
+	newlines := 1 // the start of the file counts as a line start
+	for t := l.NextItem(); t.Typ != lex.ItemEOF && t.Typ != lex.ItemError; t = l.NextItem() {
+		switch t.Typ {
+		case lex.ItemSpace:
+		case lex.ItemNewline:
+			newlines += strings.Count(t.Val, "\n")
+			if last := len(comments) - 1; last >= 0 && comments[last].before == tokens {
+				comments[last].newlineAfter = true
+				comments[last].blankAfter = newlines - 1
+			}
+		case lex.ItemComment:
+			comments = append(comments, comment{
+				text:    strings.TrimRight(t.Val, "\r"),
+				before:  tokens,
+				ownLine: newlines > 0,
+			})
+			newlines = 0
+		default:
+			tokens++
+			newlines = 0
+		}
+	}
+	return comments, tokens
+}
+
+// placeComments returns out with comments inserted. text is the source out
+// was formatted from.
+func placeComments(out, text string, opts Options) (string, error) {
+	comments, n := collectComments(opts.Filename, text)
+	if len(comments) == 0 {
+		return out, nil
+	}
+	var toks []lex.Item
+	l := lex.Lex(opts.Filename, out)
+	for t := l.NextItem(); t.Typ != lex.ItemEOF; t = l.NextItem() {
+		if t.Typ == lex.ItemError {
+			l.Close()
+			return "", fmt.Errorf("%s: formatted output does not lex: %s", opts.Filename, t.Val)
+		}
+		if !isSpace(t.Typ) {
+			toks = append(toks, t)
+		}
+	}
+	l.Close()
+	if len(toks) != n {
+		return "", changedToken(text, out, opts)
+	}
+
+	p := &commentPlacer{
+		out:         out,
+		toks:        toks,
+		unit:        opts.Indent.Text(),
+		maxNewlines: opts.MaxNewlines,
+	}
+	if p.maxNewlines <= 0 {
+		p.maxNewlines = DefaultMaxNewlines
+	}
+	var b strings.Builder
+	pos := 0
+	for len(comments) > 0 {
+		k := comments[0].before
+		i := 1
+		for i < len(comments) && comments[i].before == k {
+			i++
+		}
+		start, end := p.gapRange(k)
+		b.WriteString(out[pos:start])
+		b.WriteString(p.gap(k, out[start:end], comments[:i]))
+		pos = end
+		comments = comments[i:]
+	}
+	b.WriteString(out[pos:])
+	return b.String(), nil
+}
+
+// changedToken returns an error locating the first token, comments aside,
+// that differs between text and out, its formatted version.
+func changedToken(text, out string, opts Options) error {
+	l1 := lex.Lex(opts.Filename, text)
+	l2 := lex.Lex(opts.Filename, out)
+	defer l1.Close()
+	defer l2.Close()
+	for {
+		t1, t2 := nextCode(l1), nextCode(l2)
+		if !t1.Same(t2) || t1.Typ == lex.ItemEOF || t1.Typ == lex.ItemError {
+			return &VerifyError{
+				Pos:    l1.Position(t1),
+				OutPos: l2.Position(t2),
+				Msg:    fmt.Sprintf("formatter changed token %s to %s", describe(t1), describe(t2)),
+			}
+		}
+	}
+}
+
+// nextCode returns the next item of l that is not space, a newline or a
+// comment.
+func nextCode(l *lex.Lexer) lex.Item {
+	t := nextToken(l)
+	for t.Typ == lex.ItemComment {
+		t = nextToken(l)
+	}
+	return t
+}
+
+// commentPlacer holds the state of placeComments.
+type commentPlacer struct {
+	out         string
+	toks        []lex.Item // tokens of out
+	unit        string     // one level of indentation
+	maxNewlines int
+}
+
+// gapRange returns the range of out between token k-1 and token k.
+func (p *commentPlacer) gapRange(k int) (start, end int) {
+	if k > 0 {
+		start = int(p.toks[k-1].End)
+	}
+	end = len(p.out)
+	if k < len(p.toks) {
+		end = int(p.toks[k].Pos)
+	}
+	return start, end
+}
+
+// lineIndent returns the indentation of the line of out containing pos.
+func (p *commentPlacer) lineIndent(pos int) string {
+	line := p.out[strings.LastIndex(p.out[:pos], "\n")+1:]
+	return line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+}
+
+// gap returns the text replacing gap, the space between token k-1 and
+// token k, with the comments cs placed in it.
+func (p *commentPlacer) gap(k int, gap string, cs []comment) string {
+	var (
+		atEOF = k == len(p.toks)
+		prev  = "" // text of token k-1
+		next  = "" // text of token k
+	)
+	if k > 0 {
+		prev = p.toks[k-1].Val
+	}
+	if !atEOF {
+		next = p.toks[k].Val
+	}
+	switch {
+	case atEOF && k == 0:
+		// the file holds only comments; nothing precedes the first
+		gap = ""
+	case atEOF && !strings.Contains(gap, "\n"):
+		gap = "\n"
+	case prev == "{" && next == "}" && gap == "":
+		// open up an empty block
+		gap = "\n" + p.lineIndent(int(p.toks[k-1].Pos))
+	}
+
+	var b strings.Builder
+	if k > 0 && !strings.Contains(gap, "\n") {
+		// inline: the next token stays on this line unless a // comment
+		// ends it
+		if gap == "" && prev != "(" && prev != "[" {
+			gap = " "
+		}
+		b.WriteString(gap)
+		cont := p.lineIndent(int(p.toks[k-1].Pos)) + p.unit + p.unit
+		if prev == "}" {
+			// the token after a block, like else, starts a line at the
+			// indentation of the block's closing brace
+			cont = p.lineIndent(int(p.toks[k-1].Pos))
+		}
+		for i, c := range cs {
+			b.WriteString(c.text)
+			switch {
+			case c.isLine():
+				b.WriteString("\n" + cont)
+			case i < len(cs)-1 || !strings.ContainsAny(next, ")],;"):
+				b.WriteString(" ")
+			}
+		}
+		return b.String()
+	}
+
+	nl := gap[:strings.LastIndex(gap, "\n")+1]
+	indent := gap[len(nl):]
+	if next == "}" {
+		indent += p.unit
+	}
+	i := 0
+	for ; i < len(cs) && !cs[i].ownLine; i++ {
+		b.WriteString(" " + cs[i].text)
+	}
+	b.WriteString(nl)
+	bol := true
+	for ; i < len(cs); i++ {
+		c := cs[i]
+		if bol {
+			b.WriteString(indent)
+		}
+		b.WriteString(c.text)
+		bol = c.newlineAfter || c.isLine() || atEOF
+		if bol {
+			blank := c.blankAfter
+			if blank > p.maxNewlines-1 {
+				blank = p.maxNewlines - 1
+			}
+			b.WriteString("\n" + strings.Repeat("\n", blank))
+		} else {
+			b.WriteString(" ")
+		}
+	}
+	if bol {
+		b.WriteString(gap[len(nl):])
+	}
+	return b.String()
+}
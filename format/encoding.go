@@ -0,0 +1,133 @@
+package format
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// Encoding is the character encoding of a source file.
+type Encoding int
+
+const (
+	Auto    Encoding = iota // the encoding of the source
+	UTF8                    // UTF-8
+	UTF16LE                 // UTF-16, little endian; used by the game scripts
+	UTF16BE                 // UTF-16, big endian
+)
+
+var encodingNames = map[Encoding]string{
+	Auto:    "auto",
+	UTF8:    "utf-8",
+	UTF16LE: "utf-16le",
+	UTF16BE: "utf-16be",
+}
+
+func (e Encoding) String() string {
+	if name, ok := encodingNames[e]; ok {
+		return name
+	}
+	return fmt.Sprintf("Encoding(%d)", int(e))
+}
+
+// ParseEncoding returns the encoding named s. Names are case-insensitive
+// and the dash is optional, so "UTF8" and "utf-16le" are both accepted.
+func ParseEncoding(s string) (Encoding, error) {
+	s = strings.Replace(strings.ToLower(s), "-", "", -1)
+	for e, name := range encodingNames {
+		if strings.Replace(name, "-", "", -1) == s {
+			return e, nil
+		}
+	}
+	return Auto, fmt.Errorf("unknown encoding %q", s)
+}
+
+var (
+	bomUTF8    = []byte{0xef, 0xbb, 0xbf}
+	bomUTF16LE = []byte{0xff, 0xfe}
+	bomUTF16BE = []byte{0xfe, 0xff}
+)
+
+// DetectEncoding returns the encoding of src and whether it starts with a
+// byte order mark. Without a byte order mark, input where most characters
+// have a zero high byte is taken to be UTF-16.
+func DetectEncoding(src []byte) (enc Encoding, bom bool) {
+	switch {
+	case bytes.HasPrefix(src, bomUTF8):
+		return UTF8, true
+	case bytes.HasPrefix(src, bomUTF16LE):
+		return UTF16LE, true
+	case bytes.HasPrefix(src, bomUTF16BE):
+		return UTF16BE, true
+	case len(src) < 2 || len(src)%2 != 0:
+		return UTF8, false
+	}
+	var even, odd int
+	for i := 0; i+1 < len(src); i += 2 {
+		if src[i] == 0 {
+			even++
+		}
+		if src[i+1] == 0 {
+			odd++
+		}
+	}
+	switch pairs := len(src) / 2; {
+	case odd > pairs/2 && even == 0:
+		return UTF16LE, false
+	case even > pairs/2 && odd == 0:
+		return UTF16BE, false
+	}
+	return UTF8, false
+}
+
+// codec returns the x/text encoding of e without byte order mark handling.
+func (e Encoding) codec() encoding.Encoding {
+	switch e {
+	case UTF16LE:
+		return unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)
+	case UTF16BE:
+		return unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM)
+	}
+	return unicode.UTF8
+}
+
+// bom returns the byte order mark of e.
+func (e Encoding) bom() []byte {
+	switch e {
+	case UTF16LE:
+		return bomUTF16LE
+	case UTF16BE:
+		return bomUTF16BE
+	}
+	return bomUTF8
+}
+
+// Decode detects the encoding of src and returns its text as UTF-8, without
+// the byte order mark.
+func Decode(src []byte) (text string, enc Encoding, bom bool, err error) {
+	enc, bom = DetectEncoding(src)
+	if bom {
+		src = src[len(enc.bom()):]
+	}
+	b, err := enc.codec().NewDecoder().Bytes(src)
+	if err != nil {
+		return "", enc, bom, err
+	}
+	return string(b), enc, bom, nil
+}
+
+// Encode converts the UTF-8 text to enc, prefixed by a byte order mark if
+// bom is set. Auto is treated as UTF8.
+func Encode(text []byte, enc Encoding, bom bool) ([]byte, error) {
+	b, err := enc.codec().NewEncoder().Bytes(text)
+	if err != nil {
+		return nil, err
+	}
+	if bom {
+		b = append(append([]byte{}, enc.bom()...), b...)
+	}
+	return b, nil
+}
@@ -0,0 +1,84 @@
+package format
+
+import (
+	"bytes"
+	"testing"
+	"unicode/utf16"
+)
+
+// utf16le returns s in UTF-16LE, with a byte order mark if bom is set.
+func utf16le(s string, bom bool) []byte {
+	var b []byte
+	if bom {
+		b = append(b, bomUTF16LE...)
+	}
+	for _, u := range utf16.Encode([]rune(s)) {
+		b = append(b, byte(u), byte(u>>8))
+	}
+	return b
+}
+
+func TestDecode(t *testing.T) {
+	const text = "x = \"żółw\";\n"
+	tests := []struct {
+		name string
+		src  []byte
+		enc  Encoding
+		bom  bool
+	}{
+		{"utf-8", []byte(text), UTF8, false},
+		{"utf-8 bom", append(append([]byte{}, bomUTF8...), text...), UTF8, true},
+		{"utf-16le", utf16le(text, false), UTF16LE, false},
+		{"utf-16le bom", utf16le(text, true), UTF16LE, true},
+	}
+	for _, test := range tests {
+		got, enc, bom, err := Decode(test.src)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got != text || enc != test.enc || bom != test.bom {
+			t.Errorf("%s: Decode = %q, %v, %t, want %q, %v, %t", test.name, got, enc, bom, text, test.enc, test.bom)
+		}
+		b, err := Encode([]byte(got), enc, bom)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !bytes.Equal(b, test.src) {
+			t.Errorf("%s: Encode = % x, want % x", test.name, b, test.src)
+		}
+	}
+}
+
+// TestSourceEncoding checks that Source writes its result in the encoding
+// of the source, byte order mark included, unless told otherwise.
+func TestSourceEncoding(t *testing.T) {
+	const (
+		src  = "function F() {\nx=\"ö\";\n}\n"
+		want = "function F() {\n\tx = \"ö\";\n}\n"
+	)
+	tests := []struct {
+		name    string
+		src     []byte
+		enc     Encoding
+		wantOut []byte
+	}{
+		{"utf-8", []byte(src), Auto, []byte(want)},
+		{"utf-8 bom", append(append([]byte{}, bomUTF8...), src...), Auto, append(append([]byte{}, bomUTF8...), want...)},
+		{"utf-16le", utf16le(src, false), Auto, utf16le(want, false)},
+		{"utf-16le bom", utf16le(src, true), Auto, utf16le(want, true)},
+		{"to utf-8", utf16le(src, true), UTF8, []byte(want)},
+		{"to utf-16le", []byte(src), UTF16LE, utf16le(want, true)},
+	}
+	for _, test := range tests {
+		got, err := Source(test.src, Options{Filename: "test.ws", Encoding: test.enc})
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !bytes.Equal(got, test.wantOut) {
+			t.Errorf("%s: Source = % x, want % x", test.name, got, test.wantOut)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package format
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// LineEnding is the line terminator written to the output.
+type LineEnding int
+
+const (
+	AutoEOL LineEnding = iota // the dominant line ending of the source
+	LF                        // "\n"
+	CRLF                      // "\r\n"
+)
+
+var lineEndingNames = map[LineEnding]string{
+	AutoEOL: "auto",
+	LF:      "lf",
+	CRLF:    "crlf",
+}
+
+func (e LineEnding) String() string {
+	if name, ok := lineEndingNames[e]; ok {
+		return name
+	}
+	return fmt.Sprintf("LineEnding(%d)", int(e))
+}
+
+// ParseLineEnding returns the line ending named s: auto, lf or crlf.
+func ParseLineEnding(s string) (LineEnding, error) {
+	for e, name := range lineEndingNames {
+		if strings.EqualFold(name, s) {
+			return e, nil
+		}
+	}
+	return AutoEOL, fmt.Errorf("unknown line ending %q", s)
+}
+
+// DetectLineEnding returns the line ending used by most lines of text.
+// Ties, and text without any line break, are LF.
+func DetectLineEnding(text string) LineEnding {
+	crlf := strings.Count(text, "\r\n")
+	if crlf > strings.Count(text, "\n")-crlf {
+		return CRLF
+	}
+	return LF
+}
+
+// convertLineEndings rewrites every line break in b to eol.
+func convertLineEndings(b []byte, eol LineEnding) []byte {
+	b = bytes.Replace(b, []byte("\r\n"), []byte("\n"), -1)
+	if eol == CRLF {
+		b = bytes.Replace(b, []byte("\n"), []byte("\r\n"), -1)
+	}
+	return b
+}
@@ -0,0 +1,66 @@
+package format
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDetectLineEnding(t *testing.T) {
+	tests := []struct {
+		text string
+		want LineEnding
+	}{
+		{"", LF},
+		{"x;", LF},
+		{"x;\ny;\n", LF},
+		{"x;\r\ny;\r\n", CRLF},
+		{"x;\r\ny;\r\nz;\n", CRLF},
+		{"x;\r\ny;\nz;\n", LF},
+		{"x;\r\ny;\n", LF},
+	}
+	for _, test := range tests {
+		if got := DetectLineEnding(test.text); got != test.want {
+			t.Errorf("DetectLineEnding(%q) = %v, want %v", test.text, got, test.want)
+		}
+	}
+}
+
+// TestSourceLineEnding checks that Source ends every line of its result
+// with the line ending of most lines of the source, or the one asked for.
+func TestSourceLineEnding(t *testing.T) {
+	const want = "function F() {\n\tx = 1;\n\ty = 2;\n}\n"
+	crlf := string(convertLineEndings([]byte(want), CRLF))
+	tests := []struct {
+		name string
+		src  string
+		eol  LineEnding
+		want string
+	}{
+		{"lf", "function F() {\nx=1;\ny=2;\n}\n", AutoEOL, want},
+		{"crlf", "function F() {\r\nx=1;\r\ny=2;\r\n}\r\n", AutoEOL, crlf},
+		{"mostly crlf", "function F() {\r\nx=1;\ny=2;\r\n}\r\n", AutoEOL, crlf},
+		{"mostly lf", "function F() {\r\nx=1;\ny=2;\n}\n", AutoEOL, want},
+		{"to lf", "function F() {\r\nx=1;\r\ny=2;\r\n}\r\n", LF, want},
+		{"to crlf", "function F() {\nx=1;\ny=2;\n}\n", CRLF, crlf},
+	}
+	for _, test := range tests {
+		got, err := Source([]byte(test.src), Options{Filename: "test.ws", EOL: test.eol})
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if string(got) != test.want {
+			t.Errorf("%s: Source = %q, want %q", test.name, got, test.want)
+		}
+	}
+
+	// the line endings survive a round trip through UTF-16
+	src := utf16le("function F() {\r\nx=1;\r\ny=2;\r\n}\r\n", true)
+	got, err := Source(src, Options{Filename: "test.ws"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := utf16le(crlf, true); !bytes.Equal(got, w) {
+		t.Errorf("utf-16le crlf: Source = % x, want % x", got, w)
+	}
+}
@@ -0,0 +1,200 @@
+// Package format implements standard formatting of WitcherScript source.
+package format
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
+
+	"timmy.narnian.us/git/timmy/wsfmt/parser"
+	"timmy.narnian.us/git/timmy/wsfmt/printer"
+	"timmy.narnian.us/git/timmy/wsfmt/text/lex"
+)
+
+// DefaultMaxNewlines is the number of consecutive newlines kept when
+// Options.MaxNewlines is 0.
+const DefaultMaxNewlines = 3
+
+// Options controls the output of Source.
+type Options struct {
+	Filename    string // name of the source; used in errors
+	MaxNewlines int    // maximum number of consecutive newlines kept; 0 means 3
+	AST         bool   // parse into a syntax tree and print that instead of formatting tokens
+	Indent      Indent // one level of indentation; the zero value is a tab
+	BraceStyle  BraceStyle
+	Width       int // maximum line width, counting tabs as 4 columns; 0 means no limit
+
+	// Encoding of the result. Auto keeps the encoding and byte order mark
+	// of the source; UTF8 is written without and UTF16LE with a byte order
+	// mark.
+	Encoding Encoding
+
+	// EOL is the line ending of the result. AutoEOL uses the line ending
+	// found on most lines of the source.
+	EOL LineEnding
+}
+
+// FormatError describes a token the formatter could not handle.
+type FormatError struct {
+	Pos         lex.Position   // position of the offending token
+	State       string         // name of the state function that failed
+	Expected    []lex.ItemType // token kinds that would have been accepted, if any
+	ExpectedVal string         // exact value that would have been accepted, if any
+	Got         lex.ItemType   // kind of the offending token
+	Val         string         // value of the offending token
+	Msg         string         // description of the problem when no token was expected
+}
+
+func (e *FormatError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: ", e.Pos)
+	if e.State != "" {
+		fmt.Fprintf(&b, "%s: ", e.State)
+	}
+	switch {
+	case e.Msg != "":
+		b.WriteString(e.Msg)
+	case e.ExpectedVal != "":
+		fmt.Fprintf(&b, "expected %q got %s %q", e.ExpectedVal, kindName(e.Got), e.Val)
+	default:
+		kinds := make([]string, len(e.Expected))
+		for i, t := range e.Expected {
+			kinds[i] = kindName(t)
+		}
+		fmt.Fprintf(&b, "expected %s got %s %q", strings.Join(kinds, " or "), kindName(e.Got), e.Val)
+	}
+	return b.String()
+}
+
+// Source formats src and returns the result. src may be UTF-8 or UTF-16,
+// with or without a byte order mark; see DetectEncoding. Errors start with
+// opts.Filename or a position in it.
+func Source(src []byte, opts Options) ([]byte, error) {
+	text, enc, bom, err := Decode(src)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", opts.Filename, err)
+	}
+	out, err := formatText(text, opts)
+	if err != nil {
+		return nil, err
+	}
+	return encode(out, enc, bom, opts)
+}
+
+// formatText formats the decoded source text, ending the result with a
+// newline and converting its line endings.
+func formatText(text string, opts Options) ([]byte, error) {
+	var (
+		out []byte
+		err error
+	)
+	if opts.AST {
+		out, err = printAST(text, opts)
+	} else {
+		out, err = formatTokens(text, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	out = wrap(out, opts)
+	if len(out) > 0 && !bytes.HasSuffix(out, []byte("\n")) {
+		out = append(out, '\n')
+	}
+	eol := opts.EOL
+	if eol == AutoEOL {
+		eol = DetectLineEnding(text)
+	}
+	return convertLineEndings(out, eol), nil
+}
+
+// encode encodes out like a source in enc with or without a byte order
+// mark, unless opts asks for a particular encoding.
+func encode(out []byte, enc Encoding, bom bool, opts Options) ([]byte, error) {
+	switch opts.Encoding {
+	case UTF8:
+		enc, bom = UTF8, false
+	case UTF16LE:
+		enc, bom = UTF16LE, true
+	}
+	b, err := Encode(out, enc, bom)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", opts.Filename, err)
+	}
+	return b, nil
+}
+
+// LexErrors returns every lexical error in src. The scan goes on after
+// each error, so one bad character does not hide the ones after it.
+func LexErrors(src []byte, opts Options) ([]*lex.Error, error) {
+	text, _, _, err := Decode(src)
+	if err != nil {
+		return nil, err
+	}
+	l := lex.Lex(opts.Filename, text)
+	defer l.Close()
+	l.SetRecovery(true)
+	for t := l.NextItem(); t.Typ != lex.ItemEOF; t = l.NextItem() {
+	}
+	return l.Errors(), nil
+}
+
+// formatTokens formats text with the token state machine.
+func formatTokens(text string, opts Options) ([]byte, error) {
+	f := &formatter{
+		l:             lex.Lex(opts.Filename, text),
+		maxNewlines:   opts.MaxNewlines,
+		indent:        opts.Indent.Text(),
+		braceNextLine: opts.BraceStyle == NextLine,
+		nextToken:     blank,
+	}
+	if f.maxNewlines <= 0 {
+		f.maxNewlines = DefaultMaxNewlines
+	}
+	f.run()
+	f.l.Close()
+	if f.err != nil {
+		return nil, f.err
+	}
+	out, err := placeComments(f.Output.String(), text, opts)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(out), nil
+}
+
+// printAST formats text by parsing it and printing the syntax tree.
+func printAST(text string, opts Options) ([]byte, error) {
+	file, err := parser.ParseFile(opts.Filename, text)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	cfg := printer.Config{
+		MaxNewlines:   opts.MaxNewlines,
+		Indent:        opts.Indent.Text(),
+		BraceNextLine: opts.BraceStyle == NextLine,
+	}
+	if err := cfg.Fprint(&buf, file); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// kindName returns the name of a token kind for messages.
+func kindName(t lex.ItemType) string {
+	if name, ok := lex.Rkey[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("item(%d)", int(t))
+}
+
+// stateName returns the name of a formatter state function for messages.
+func stateName(state stateFn) string {
+	if state == nil {
+		return ""
+	}
+	name := runtime.FuncForPC(reflect.ValueOf(state).Pointer()).Name()
+	return name[strings.LastIndexByte(name, '.')+1:]
+}
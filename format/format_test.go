@@ -0,0 +1,115 @@
+package format
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"timmy.narnian.us/git/timmy/wsfmt/diff"
+	"timmy.narnian.us/git/timmy/wsfmt/text/lex"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files from the current output")
+
+// TestGolden formats every .ws file in testdata and compares the result
+// with the .golden file next to it, both with the token formatter and by
+// printing the syntax tree. Each result must also format to itself. With
+// -update the golden files are rewritten from the token formatter instead.
+func TestGolden(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.ws"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no .ws files in testdata")
+	}
+	for _, file := range files {
+		for _, ast := range []bool{false, true} {
+			name := filepath.Base(file)
+			if ast {
+				name += "/ast"
+			}
+			file, ast := file, ast
+			t.Run(name, func(t *testing.T) {
+				checkGolden(t, file, Options{Filename: file, AST: ast})
+			})
+		}
+	}
+}
+
+// checkGolden formats file with opts and compares the result with its
+// golden file.
+func checkGolden(t *testing.T, file string, opts Options) {
+	src, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Source(src, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	golden := strings.TrimSuffix(file, ".ws") + ".golden"
+	if *update && !opts.AST {
+		if err := ioutil.WriteFile(golden, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		want, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := diff.Unified(golden, "output", string(want), string(got), 3); d != "" {
+			t.Errorf("output differs from golden file\n%s", d)
+		}
+	}
+
+	opts.Filename = golden
+	again, err := Source(got, opts)
+	if err != nil {
+		t.Fatalf("formatting the output: %v", err)
+	}
+	if d := diff.Unified("output", "reformatted", string(got), string(again), 3); d != "" {
+		t.Errorf("formatting is not idempotent\n%s", d)
+	}
+}
+
+// TestUnbalanced checks that input with more closing scopes than opening
+// ones is reported as an error instead of crashing the formatter.
+func TestUnbalanced(t *testing.T) {
+	for _, src := range []string{
+		"}\n",
+		"function F() {\n}\n}\n",
+		"if (a) x;\n",
+		"else x;\n",
+		"x = 1;\ncase 1:\n",
+	} {
+		_, err := Source([]byte(src), Options{Filename: "test.ws"})
+		if _, ok := err.(*FormatError); !ok {
+			t.Errorf("Source(%q) error = %v (%T), want a *FormatError", src, err, err)
+		}
+	}
+}
+
+// TestExpectedVal checks the kind of token an error says was expected
+// where one exact operator or character was.
+func TestExpectedVal(t *testing.T) {
+	tests := []struct {
+		src  string
+		want lex.ItemType
+	}{
+		{"enum E {\n\tA B\n}\n", lex.ItemChar},
+		{"var a : array<int;\n", lex.ItemGreater},
+		{"var a : array int;\n", lex.ItemLess},
+		{"function F() {\n\tswitch (x) {\n\tcase 1 x;\n\t}\n}\n", lex.ItemColon},
+	}
+	for _, test := range tests {
+		_, err := Source([]byte(test.src), Options{Filename: "test.ws"})
+		e, ok := err.(*FormatError)
+		if !ok || len(e.Expected) != 1 || e.Expected[0] != test.want {
+			t.Errorf("Source(%q) error = %v, want %s expected", test.src, err, lex.Rkey[test.want])
+		}
+	}
+}
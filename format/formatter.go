@@ -0,0 +1,751 @@
+package format
+
+import (
+	"fmt"
+	"strings"
+
+	"timmy.narnian.us/git/timmy/wsfmt/text/lex"
+)
+
+type stateFn func(*formatter) stateFn
+
+type formatter struct {
+	l             *lex.Lexer
+	previousToken lex.Item
+	token         lex.Item
+	nextToken     lex.Item
+	state         stateFn
+	err           *FormatError
+	maxNewlines   int
+	indent        string // text of one level of indentation
+	braceNextLine bool   // opening braces go on a line of their own
+	newlineCount  int
+	parenDepth    int
+	arrayDepth    int   // array< opened by formatArray and not yet closed
+	ternaryDepth  int   // ? of conditional expressions still waiting for their :
+	pendingSwitch bool  // a switch statement is waiting for its opening brace
+	switchScopes  []int // len(scopeLevel) inside each enclosing switch body
+	Output        strings.Builder
+	scopeLevel    []int
+	// Each index is one scope deep delimited by braces or case statement.
+	// the number is how many 'soft' scopes deep it is resets to 1 on newline e.g. an if statement without braces
+}
+
+var blank = lex.Item{Pos: -1}
+
+func (f *formatter) next() lex.Item {
+	f.previousToken = f.token
+	var temp lex.Item
+
+	if f.nextToken == blank {
+		temp = f.l.NextItem()
+	} else {
+		temp = f.nextToken
+		f.nextToken = blank
+	}
+	for ; isSpace(temp.Typ); temp = f.l.NextItem() {
+	}
+
+	f.token = temp
+	return f.token
+}
+
+func (f *formatter) peek() lex.Item {
+	if f.nextToken == blank {
+		temp := f.l.NextItem()
+		count := 0
+		counting := true
+		for ; isSpace(temp.Typ); temp = f.l.NextItem() {
+			switch {
+			case temp.Typ == lex.ItemComment && count > 0:
+				// the blank lines after a comment on a line of its own
+				// are kept by placeComments
+				counting = false
+			case temp.Typ == lex.ItemNewline && counting:
+				count += strings.Count(temp.Val, "\n")
+			}
+		}
+		if count < f.maxNewlines {
+			f.newlineCount = count
+		} else {
+			f.newlineCount = f.maxNewlines
+		}
+		f.nextToken = temp
+	}
+	return f.nextToken
+}
+
+// isSpace reports whether items of type t are skipped between tokens.
+// Comments are skipped too and put back by placeComments.
+func isSpace(t lex.ItemType) bool {
+	return t == lex.ItemSpace || t == lex.ItemNewline || t == lex.ItemComment
+}
+
+func (f *formatter) run() {
+	for f.state = format; f.state != nil; {
+		f.state = f.state(f)
+	}
+}
+
+// errorf records an error at the current token and terminates formatting.
+func (f *formatter) errorf(format string, args ...interface{}) stateFn {
+	f.err = f.newError()
+	f.err.Msg = fmt.Sprintf(format, args...)
+	return nil
+}
+
+// expected records that the current token is not one of the expected kinds
+// and terminates formatting.
+func (f *formatter) expected(typ ...lex.ItemType) stateFn {
+	f.err = f.newError()
+	f.err.Expected = typ
+	return nil
+}
+
+// expectedVal records that the current token is not the expected operator
+// or character and terminates formatting.
+func (f *formatter) expectedVal(val string) stateFn {
+	typ, ok := lex.Operator(val)
+	if !ok {
+		typ = lex.ItemChar // , or ;
+	}
+	f.err = f.newError()
+	f.err.Expected = []lex.ItemType{typ}
+	f.err.ExpectedVal = val
+	return nil
+}
+
+func (f *formatter) newError() *FormatError {
+	return &FormatError{
+		Pos:   f.l.Position(f.token),
+		State: stateName(f.state),
+		Got:   f.token.Typ,
+		Val:   f.token.Val,
+	}
+}
+
+func format(f *formatter) stateFn {
+	switch t := f.next().Typ; {
+	case t == lex.ItemEOF:
+		return nil
+	case t == lex.ItemError:
+		return f.errorf("%s", f.token.Val)
+	case t == lex.ItemFunction, t == lex.ItemEvent:
+		return formatFunction
+	case t == lex.ItemIf, t == lex.ItemWhile, t == lex.ItemFor, t == lex.ItemSwitch:
+		return formatConditional
+	case t == lex.ItemElse:
+		if f.previousToken.Typ == lex.ItemRightBrace && f.braceNextLine {
+			f.Output.WriteString("\n")
+			printTab(f)
+			f.Output.WriteString("else")
+		} else if f.previousToken.Typ == lex.ItemRightBrace {
+			f.Output.WriteString(" else")
+		} else {
+			f.Output.WriteString("else")
+		}
+		if f.peek().Typ != lex.ItemLeftBrace && f.peek().Typ != lex.ItemIf {
+			if len(f.scopeLevel) == 0 {
+				return f.errorf("unexpected %q", f.token.Val)
+			}
+			f.scopeLevel[len(f.scopeLevel)-1]++
+			printNewline(f)
+			printTab(f)
+		}
+	case t == lex.ItemReturn:
+		f.Output.WriteString(f.token.Val + " ")
+	case t == lex.ItemDefault && f.peek().Val == ":":
+		return formatDefault
+	case t == lex.ItemModifiers, t == lex.ItemIdentifier, t == lex.ItemNumber, t == lex.ItemBool, t == lex.ItemString, t == lex.ItemName, isWord(t):
+		if !printIdentifier(f) {
+			return f.errorf("invalid identifier: trailing dot '.'")
+		}
+	case isChar(t):
+		return printChar(f)
+	case t == lex.ItemStruct:
+		return formatStruct
+	case t == lex.ItemVar:
+		return formatVar
+	case t.IsOperator():
+		printOperator(f)
+	case t == lex.ItemArray:
+		return formatArray
+	case t == lex.ItemCase:
+		return formatCase
+	case t == lex.ItemEnum:
+		return formatEnum
+	case t == lex.ItemClass:
+		return formatClass
+	case t == lex.ItemState:
+		return formatState
+	default:
+		return f.expected(lex.ItemIdentifier)
+	}
+	return format
+}
+
+func formatFunction(f *formatter) stateFn {
+	if f.token.Typ == lex.ItemFunction || f.token.Typ == lex.ItemEvent {
+		f.Output.WriteString(f.token.Val + " ")
+	}
+
+	switch t := f.next().Typ; {
+	case t == lex.ItemEOF:
+		return f.expected(lex.ItemIdentifier)
+	case t == lex.ItemIdentifier:
+		if !printIdentifier(f) {
+			return f.errorf("invalid identifier: trailing dot '.'")
+		}
+		if f.next().Typ == lex.ItemLeftParen {
+			printChar(f)
+			return format
+		}
+		return f.expected(lex.ItemLeftParen)
+	}
+	return f.expected(lex.ItemIdentifier)
+}
+
+func formatStruct(f *formatter) stateFn {
+	if f.token.Typ == lex.ItemStruct {
+		if !printIdentifier(f) {
+			return f.errorf("invalid identifier: trailing dot '.'")
+		}
+	}
+	switch t := f.next().Typ; {
+	case t == lex.ItemEOF:
+		return f.expected(lex.ItemIdentifier)
+	case t == lex.ItemIdentifier:
+		if !printIdentifier(f) {
+			return f.errorf("invalid identifier: trailing dot '.'")
+		}
+		return format
+	default:
+		return f.expected(lex.ItemIdentifier)
+	}
+}
+
+// formatClass formats the header of a class declaration:
+// class Name [extends Base] {
+func formatClass(f *formatter) stateFn {
+	f.Output.WriteString(f.token.Val + " ")
+	if f.next().Typ != lex.ItemIdentifier {
+		return f.expected(lex.ItemIdentifier)
+	}
+	f.Output.WriteString(f.token.Val)
+	return formatExtends
+}
+
+// formatState formats the header of a state declaration:
+// state Name in Class [extends Base] {
+func formatState(f *formatter) stateFn {
+	f.Output.WriteString(f.token.Val + " ")
+	if f.next().Typ != lex.ItemIdentifier {
+		return f.expected(lex.ItemIdentifier)
+	}
+	f.Output.WriteString(f.token.Val)
+	if f.next().Typ != lex.ItemIn {
+		return f.expected(lex.ItemIn)
+	}
+	if f.next().Typ != lex.ItemIdentifier {
+		return f.expected(lex.ItemIdentifier)
+	}
+	f.Output.WriteString(" in " + f.token.Val)
+	return formatExtends
+}
+
+// formatExtends formats the optional extends clause of a class or state
+// header. The opening brace is left for format so the body gets its scope.
+func formatExtends(f *formatter) stateFn {
+	if f.peek().Typ == lex.ItemExtends {
+		f.next()
+		if f.next().Typ != lex.ItemIdentifier {
+			return f.expected(lex.ItemIdentifier)
+		}
+		f.Output.WriteString(" extends " + f.token.Val)
+	}
+	if f.peek().Typ != lex.ItemLeftBrace {
+		f.next()
+		return f.expected(lex.ItemExtends, lex.ItemLeftBrace)
+	}
+	return format
+}
+
+func formatVar(f *formatter) stateFn {
+	if !printIdentifier(f) {
+		return f.errorf("invalid identifier: trailing dot '.'")
+	}
+	for notdone := true; notdone; {
+		if f.next().Typ == lex.ItemIdentifier {
+			if !printIdentifier(f) {
+				return f.errorf("invalid identifier: trailing dot '.'")
+			}
+			if t := f.next().Typ; t == lex.ItemChar || t == lex.ItemColon {
+				switch f.token.Val {
+				case ",":
+					printChar(f)
+				case ":":
+					printChar(f)
+					notdone = false
+				default:
+					return f.expected(lex.ItemIdentifier)
+
+				}
+			} else {
+				return f.expected(lex.ItemIdentifier)
+
+			}
+		} else {
+			return f.expected(lex.ItemIdentifier)
+
+		}
+	}
+	switch f.next().Typ {
+	case lex.ItemIdentifier:
+		if !printIdentifier(f) {
+			return f.errorf("invalid identifier: trailing dot '.'")
+		}
+	case lex.ItemArray:
+		return formatArray
+	default:
+		return f.expected(lex.ItemIdentifier)
+
+	}
+	return format
+}
+
+func printIdentifier(f *formatter) bool {
+	switch i := f.peek(); {
+	case i.Val == "{", i.Val == "}", i.Val == "(", i.Val == ")", i.Val == "[", i.Val == "]", i.Val == "|", i.Val == ",", i.Val == ":", i.Val == ";",
+		i.Typ == lex.ItemIncrement, i.Typ == lex.ItemDecrement:
+		f.Output.WriteString(f.token.Val)
+	case i.Typ == lex.ItemDot:
+		f.Output.WriteString(f.token.Val)
+		f.next()
+		return printDot(f)
+	default:
+		f.Output.WriteString(f.token.Val + " ")
+	}
+	return true
+}
+
+func printDot(f *formatter) bool {
+	f.Output.WriteString(".")
+	if f.peek().Typ == lex.ItemIdentifier {
+		f.next()
+		return printIdentifier(f)
+	}
+	return false
+}
+
+func printOperator(f *formatter) {
+	str := "%s"
+	switch f.token.Typ {
+	case lex.ItemOr, lex.ItemNot, lex.ItemTilde:
+	case lex.ItemIncrement, lex.ItemDecrement:
+		// prefix operators stick to their operand, postfix ones to the
+		// operand before them
+		if isOperand(f.previousToken) {
+			switch f.peek().Typ {
+			case lex.ItemChar, lex.ItemRightParen, lex.ItemRightBracket:
+			default:
+				str = "%s "
+			}
+		}
+		f.Output.WriteString(fmt.Sprintf(apart(f, str), f.token.Val))
+		return
+	case lex.ItemAdd, lex.ItemSub:
+		switch t := f.previousToken.Typ; {
+		case t == lex.ItemLeftParen, t == lex.ItemLeftBracket, t == lex.ItemQuestion, t == lex.ItemColon,
+			t.IsOperator(), t == lex.ItemReturn, t == lex.ItemCase:
+		default:
+			str = "%s "
+		}
+	default:
+		str = "%s "
+	}
+	switch f.previousToken.Typ {
+	case lex.ItemRightParen, lex.ItemRightBracket:
+		str = " " + str
+	}
+	f.Output.WriteString(fmt.Sprintf(apart(f, str), f.token.Val))
+}
+
+// apart adds a space to str, the format of an operator printed without
+// one after it, if the operator that follows would otherwise lex together
+// with it, as in - -c.
+func apart(f *formatter, str string) string {
+	if strings.HasSuffix(str, " ") {
+		return str
+	}
+	if next := f.peek(); next.Typ.IsOperator() {
+		if _, ok := lex.Operator(f.token.Val + next.Val[:1]); ok {
+			return str + " "
+		}
+	}
+	return str
+}
+
+func formatConditional(f *formatter) stateFn {
+	switch f.token.Typ {
+	case lex.ItemIf, lex.ItemWhile, lex.ItemFor, lex.ItemSwitch:
+		if f.previousToken.Typ == lex.ItemElse {
+			f.Output.WriteString(" ")
+		}
+		f.pendingSwitch = f.token.Typ == lex.ItemSwitch
+		if f.next().Typ != lex.ItemLeftParen {
+			return f.expected(lex.ItemLeftParen)
+		}
+		f.Output.WriteString(f.previousToken.Val + " (")
+		f.parenDepth = 1
+	}
+
+	switch t := f.next().Typ; {
+	case t == lex.ItemEOF:
+		return f.expected(lex.ItemIdentifier)
+	case t.IsOperator():
+		printOperator(f)
+	case t == lex.ItemIdentifier, t == lex.ItemNumber, t == lex.ItemString, t == lex.ItemName, t == lex.ItemBool, isWord(t):
+		if !printIdentifier(f) {
+			return f.expected(lex.ItemIdentifier)
+		}
+	case isChar(t):
+		if f.token.Val == ";" {
+			f.Output.WriteString("; ")
+		} else {
+			printChar(f)
+		}
+		switch f.token.Val {
+		case ")":
+			f.parenDepth--
+			if f.parenDepth == 0 {
+				if f.peek().Typ != lex.ItemLeftBrace {
+					if len(f.scopeLevel) == 0 {
+						return f.errorf("unexpected %q", f.token.Val)
+					}
+					f.scopeLevel[len(f.scopeLevel)-1]++
+					printNewline(f)
+					printTab(f)
+				}
+				return format
+			}
+		case "(":
+			f.parenDepth++
+		}
+	}
+	return formatConditional
+}
+
+func formatNewLine(f *formatter) stateFn {
+
+	switch t := f.peek().Typ; {
+	case t == lex.ItemEOF:
+		f.Output.WriteString("\n")
+		return nil
+	case t == lex.ItemError:
+		f.next()
+		return f.errorf("%s", f.token.Val)
+	case t == lex.ItemCase, t == lex.ItemDefault && f.inSwitch():
+		if len(f.scopeLevel) == 0 {
+			f.next()
+			return f.errorf("unexpected %q", f.token.Val)
+		}
+		printNewline(f)
+		f.scopeLevel = f.scopeLevel[:len(f.scopeLevel)-1]
+		printTab(f)
+	case f.peek().Val == ";" || f.peek().Val == "}":
+	default:
+		printNewline(f)
+		printTab(f)
+	}
+
+	return format
+}
+
+func formatEnum(f *formatter) stateFn {
+	if !printIdentifier(f) {
+		return f.errorf("invalid identifier: trailing dot '.'")
+	}
+	if f.next().Typ != lex.ItemIdentifier {
+		return f.expected(lex.ItemIdentifier)
+	}
+	if !printIdentifier(f) {
+		return f.expected(lex.ItemIdentifier)
+	}
+	if f.next().Typ != lex.ItemLeftBrace {
+		return f.expected(lex.ItemLeftBrace)
+	}
+
+	f.printLeftBrace()
+	f.scopeLevel = append(f.scopeLevel, 1)
+	if f.peek().Typ == lex.ItemRightBrace {
+		return format
+	}
+	printNewline(f)
+	printTab(f)
+	return formatEnumIdent
+}
+
+func formatEnumIdent(f *formatter) stateFn {
+	if f.next().Typ != lex.ItemIdentifier {
+		return f.expected(lex.ItemIdentifier)
+	}
+	if !printIdentifier(f) {
+		return f.expected(lex.ItemIdentifier)
+	}
+	switch f.peek().Val {
+	case "=":
+		f.next()
+		printOperator(f)
+		if f.peek().Typ != lex.ItemNumber {
+			return f.expected(lex.ItemNumber)
+		}
+		f.next()
+		if !printIdentifier(f) {
+			return f.expected(lex.ItemIdentifier)
+		}
+		if f.peek().Typ == lex.ItemRightBrace {
+			return format
+		}
+	case "}":
+		return format
+	}
+	return formatEnumChar
+}
+
+func formatEnumChar(f *formatter) stateFn {
+	if f.next().Val != "," {
+		return f.expectedVal(",")
+	}
+
+	f.Output.WriteString(",")
+	if f.peek().Typ == lex.ItemRightBrace {
+		return format
+	}
+	printNewline(f)
+	printTab(f)
+	return formatEnumIdent
+}
+
+func formatRightBrace(f *formatter) stateFn {
+	if f.inSwitch() {
+		f.switchScopes = f.switchScopes[:len(f.switchScopes)-1]
+	}
+	if len(f.scopeLevel) == 0 {
+		return f.errorf("unexpected %q", f.token.Val)
+	}
+	f.scopeLevel = f.scopeLevel[:len(f.scopeLevel)-1]
+	if f.previousToken.Typ != lex.ItemLeftBrace {
+		f.Output.WriteString("\n")
+		printTab(f)
+	}
+	f.Output.WriteString("}")
+
+	switch f.peek().Typ {
+	case lex.ItemChar, lex.ItemElse, lex.ItemRightBrace:
+		return format
+	}
+	return formatNewLine
+}
+
+func formatCase(f *formatter) stateFn {
+	if !printIdentifier(f) {
+		return f.errorf("invalid identifier: trailing dot '.'")
+	}
+	switch f.next().Typ {
+	case lex.ItemLeftParen:
+		f.Output.WriteString(" (")
+		if f.next().Typ != lex.ItemIdentifier || !printIdentifier(f) {
+			return f.expected(lex.ItemIdentifier)
+		}
+		if f.next().Typ != lex.ItemRightParen {
+			return f.expected(lex.ItemRightParen)
+		}
+		f.Output.WriteString(")")
+		if f.next().Typ != lex.ItemIdentifier || !printIdentifier(f) {
+			return f.expected(lex.ItemIdentifier)
+		}
+	case lex.ItemIdentifier, lex.ItemNumber, lex.ItemString, lex.ItemName:
+		if !printIdentifier(f) {
+			return f.expected(lex.ItemIdentifier)
+		}
+	case lex.ItemAdd, lex.ItemSub:
+		if f.peek().Typ != lex.ItemNumber {
+			return f.errorf("invalid operator %q", f.token.Val)
+		}
+		printOperator(f)
+		f.next()
+		if !printIdentifier(f) {
+			return f.expected(lex.ItemIdentifier)
+		}
+	default:
+		if f.token.Typ.IsOperator() {
+			return f.errorf("invalid operator %q", f.token.Val)
+		}
+	}
+
+	return formatCaseColon
+}
+
+func formatDefault(f *formatter) stateFn {
+	f.Output.WriteString(f.token.Val)
+	return formatCaseColon
+}
+
+// formatCaseColon finishes a case or default label and opens its scope.
+func formatCaseColon(f *formatter) stateFn {
+	if f.next().Val != ":" {
+		return f.expectedVal(":")
+	}
+	f.Output.WriteString(":")
+	f.scopeLevel = append(f.scopeLevel, 1)
+	return formatNewLine
+}
+
+// formatArray formats the type array<T>. The lexer splits the closers of
+// nested arrays into one > each, so after the innermost element type one >
+// is expected for every array opened since the outermost.
+func formatArray(f *formatter) stateFn {
+	if f.next().Typ != lex.ItemLess {
+		return f.expectedVal("<")
+	}
+	f.Output.WriteString("array<")
+	f.arrayDepth++
+	switch f.next().Typ {
+	case lex.ItemIdentifier:
+		for {
+			f.Output.WriteString(f.token.Val)
+			if f.peek().Typ != lex.ItemDot {
+				break
+			}
+			f.next()
+			f.Output.WriteString(".")
+			if f.peek().Typ != lex.ItemIdentifier {
+				return f.expected(lex.ItemIdentifier)
+			}
+			f.next()
+		}
+	case lex.ItemArray:
+		return formatArray
+	default:
+		return f.expected(lex.ItemIdentifier, lex.ItemArray)
+	}
+	for ; f.arrayDepth > 0; f.arrayDepth-- {
+		if f.next().Typ != lex.ItemGreater {
+			return f.expectedVal(">")
+		}
+		f.Output.WriteString(">")
+	}
+	if f.peek().Typ.IsOperator() {
+		f.Output.WriteString(" ")
+	}
+	return format
+}
+
+func printTab(f *formatter) {
+	for _, t := range f.scopeLevel {
+		for i := 0; i < t; i++ {
+			f.Output.WriteString(f.indent)
+		}
+	}
+}
+
+func isChar(t lex.ItemType) bool {
+	switch t {
+	case lex.ItemChar, lex.ItemLeftParen, lex.ItemRightParen, lex.ItemLeftBrace, lex.ItemRightBrace,
+		lex.ItemLeftBracket, lex.ItemRightBracket, lex.ItemQuestion, lex.ItemColon, lex.ItemDot:
+		return true
+	default:
+		return false
+	}
+}
+
+// isWord reports whether t is a keyword that is printed like an identifier.
+func isWord(t lex.ItemType) bool {
+	switch t {
+	case lex.ItemBreak, lex.ItemContinue, lex.ItemNew, lex.ItemDelete, lex.ItemIn,
+		lex.ItemThis, lex.ItemSuper, lex.ItemParent, lex.ItemVirtualParent, lex.ItemNULL,
+		lex.ItemExtends, lex.ItemLatent, lex.ItemCleanup,
+		lex.ItemReward, lex.ItemHint, lex.ItemDefault, lex.ItemDefaults, lex.ItemAutobind,
+		lex.ItemOptional, lex.ItemSingle:
+		return true
+	default:
+		return false
+	}
+}
+
+// inSwitch reports whether the innermost scope is the body of a switch.
+func (f *formatter) inSwitch() bool {
+	return len(f.switchScopes) > 0 && f.switchScopes[len(f.switchScopes)-1] == len(f.scopeLevel)
+}
+
+func printChar(f *formatter) stateFn {
+	switch f.token.Val {
+	case "?":
+		f.ternaryDepth++
+		f.printSpaced()
+	case ":":
+		if f.ternaryDepth > 0 {
+			f.ternaryDepth--
+			f.printSpaced()
+		} else {
+			f.Output.WriteString(": ")
+		}
+	case ",":
+		f.Output.WriteString(", ")
+	case ";":
+		f.ternaryDepth = 0
+		f.Output.WriteString(";")
+		if len(f.scopeLevel) > 0 {
+			f.scopeLevel[len(f.scopeLevel)-1] = 1
+		}
+		return formatNewLine
+	case "{":
+		f.printLeftBrace()
+		f.scopeLevel = append(f.scopeLevel, 1)
+		if f.pendingSwitch {
+			f.switchScopes = append(f.switchScopes, len(f.scopeLevel))
+			f.pendingSwitch = false
+		}
+		return formatNewLine
+	case "}":
+		return formatRightBrace
+	case ".":
+		printDot(f)
+	default:
+		f.Output.WriteString(f.token.Val)
+	}
+	return format
+}
+
+// printSpaced writes the current token with a space on each side, as for
+// the ? and : of a conditional expression.
+func (f *formatter) printSpaced() {
+	if !strings.HasSuffix(f.Output.String(), " ") {
+		f.Output.WriteString(" ")
+	}
+	f.Output.WriteString(f.token.Val + " ")
+}
+
+// printLeftBrace writes an opening brace at the end of the current line,
+// or on a line of its own if braceNextLine is set.
+func (f *formatter) printLeftBrace() {
+	if f.braceNextLine {
+		f.Output.WriteString("\n")
+		printTab(f)
+		f.Output.WriteString("{")
+		return
+	}
+	f.Output.WriteString(" {")
+}
+
+// printNewline ends the line, keeping up to maxNewlines of the newlines
+// that preceded the next token in the input.
+func printNewline(f *formatter) {
+	f.peek()
+	if f.nextToken.Typ != lex.ItemEOF {
+		f.Output.WriteString("\n")
+		for i := 1; i < f.newlineCount; i++ {
+			f.Output.WriteString("\n")
+		}
+	}
+}
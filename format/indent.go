@@ -0,0 +1,51 @@
+package format
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Indent is the text written for one level of indentation: a tab when
+// Spaces is 0, otherwise that many spaces. Indent implements flag.Value.
+type Indent struct {
+	Spaces int
+}
+
+// ParseIndent returns the indentation named s: "tab", or a number of
+// spaces.
+func ParseIndent(s string) (Indent, error) {
+	if strings.EqualFold(s, "tab") || strings.EqualFold(s, "tabs") {
+		return Indent{}, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return Indent{}, fmt.Errorf("invalid indentation %q: want \"tab\" or a number of spaces", s)
+	}
+	return Indent{Spaces: n}, nil
+}
+
+func (i Indent) String() string {
+	if i.Spaces == 0 {
+		return "tab"
+	}
+	return strconv.Itoa(i.Spaces)
+}
+
+// Set implements flag.Value.
+func (i *Indent) Set(s string) error {
+	v, err := ParseIndent(s)
+	if err != nil {
+		return err
+	}
+	*i = v
+	return nil
+}
+
+// Text returns the text of one level of indentation.
+func (i Indent) Text() string {
+	if i.Spaces == 0 {
+		return "\t"
+	}
+	return strings.Repeat(" ", i.Spaces)
+}
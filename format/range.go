@@ -0,0 +1,124 @@
+package format
+
+import (
+	"fmt"
+	"strings"
+
+	"timmy.narnian.us/git/timmy/wsfmt/text/lex"
+)
+
+// Range formats the statements of src that overlap lines first through
+// last, counting from 1, and leaves every other line of src exactly as it
+// is. The whole of src is formatted to find the indentation of the range,
+// so src must be free of syntax errors outside the range too. Errors are
+// reported as by Source.
+func Range(src []byte, first, last int, opts Options) ([]byte, error) {
+	if first < 1 || last < first {
+		return nil, fmt.Errorf("%s: invalid line range %d:%d", opts.Filename, first, last)
+	}
+	text, enc, bom, err := Decode(src)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", opts.Filename, err)
+	}
+	out, err := formatText(text, opts)
+	if err != nil {
+		return nil, err
+	}
+	res, err := splice(text, string(out), first, last, opts)
+	if err != nil {
+		return nil, err
+	}
+	return encode([]byte(res), enc, bom, opts)
+}
+
+// splice replaces the lines of text holding the statements that overlap
+// lines first through last with the lines of out, its formatted version,
+// holding the same tokens.
+//
+// The range is widened until it starts with a token that begins a line
+// and ends with a token that ends a line, both in text and in out. As the
+// formatter puts every statement on a line of its own, these are
+// statement boundaries, and a statement that only partly overlaps the
+// range is formatted whole.
+func splice(text, out string, first, last int, opts Options) (string, error) {
+	src, err := lineTokens(opts.Filename, text)
+	if err != nil {
+		return "", err
+	}
+	dst, err := lineTokens(opts.Filename, out)
+	if err != nil {
+		return "", fmt.Errorf("%s: formatted output does not lex: %v", opts.Filename, err)
+	}
+	if len(src) != len(dst) {
+		return "", fmt.Errorf("%s: formatting changed the number of tokens from %d to %d", opts.Filename, len(src), len(dst))
+	}
+
+	a, b := -1, -1
+	for i, t := range src {
+		if t.end >= first && t.Line <= last {
+			if a < 0 {
+				a = i
+			}
+			b = i
+		}
+	}
+	if a < 0 {
+		// only space in the range
+		return text, nil
+	}
+	for a > 0 && !(startsLine(src, a) && startsLine(dst, a)) {
+		a--
+	}
+	for b < len(src)-1 && !(endsLine(src, b) && endsLine(dst, b)) {
+		b++
+	}
+
+	lines := strings.SplitAfter(text, "\n")
+	outLines := strings.SplitAfter(out, "\n")
+	var buf strings.Builder
+	for _, s := range lines[:src[a].Line-1] {
+		buf.WriteString(s)
+	}
+	for _, s := range outLines[dst[a].Line-1 : dst[b].end] {
+		buf.WriteString(s)
+	}
+	if src[b].end < len(lines) {
+		for _, s := range lines[src[b].end:] {
+			buf.WriteString(s)
+		}
+	}
+	return buf.String(), nil
+}
+
+// lineToken is a token, comments included, with the line it ends on.
+type lineToken struct {
+	lex.Item
+	end int
+}
+
+// lineTokens returns the tokens of text that are not space or newlines.
+func lineTokens(name, text string) ([]lineToken, error) {
+	var toks []lineToken
+	l := lex.Lex(name, text)
+	defer l.Close()
+	for t := l.NextItem(); t.Typ != lex.ItemEOF; t = l.NextItem() {
+		switch t.Typ {
+		case lex.ItemError:
+			return nil, fmt.Errorf("%s: %s", l.Position(t), t.Val)
+		case lex.ItemSpace, lex.ItemNewline:
+			continue
+		}
+		toks = append(toks, lineToken{t, t.Line + strings.Count(t.Val, "\n")})
+	}
+	return toks, nil
+}
+
+// startsLine reports whether toks[i] is the first token on its line.
+func startsLine(toks []lineToken, i int) bool {
+	return i == 0 || toks[i-1].end < toks[i].Line
+}
+
+// endsLine reports whether toks[i] is the last token on its line.
+func endsLine(toks []lineToken, i int) bool {
+	return i == len(toks)-1 || toks[i+1].Line > toks[i].end
+}
@@ -0,0 +1,83 @@
+package format
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRange(t *testing.T) {
+	src := "function F() {\n" +
+		"x=1;\n" +
+		"y=2;\n" +
+		"if (a) {\n" +
+		"z=F(1,\n" +
+		"2);\n" +
+		"}\n" +
+		"}\n"
+	tests := []struct {
+		name        string
+		first, last int
+		want        string
+	}{
+		{
+			// the lines around the range keep their layout
+			"one line", 2, 2,
+			"function F() {\n" +
+				"\tx = 1;\n" +
+				"y=2;\n" +
+				"if (a) {\n" +
+				"z=F(1,\n" +
+				"2);\n" +
+				"}\n" +
+				"}\n",
+		},
+		{
+			// the indentation comes from the enclosing blocks
+			"nested", 4, 4,
+			"function F() {\n" +
+				"x=1;\n" +
+				"y=2;\n" +
+				"\tif (a) {\n" +
+				"z=F(1,\n" +
+				"2);\n" +
+				"}\n" +
+				"}\n",
+		},
+		{
+			// a statement partly in the range is formatted whole
+			"partial", 6, 6,
+			"function F() {\n" +
+				"x=1;\n" +
+				"y=2;\n" +
+				"if (a) {\n" +
+				"\t\tz = F(1, 2);\n" +
+				"}\n" +
+				"}\n",
+		},
+		{
+			"middle", 3, 3,
+			"function F() {\n" +
+				"x=1;\n" +
+				"\ty = 2;\n" +
+				"if (a) {\n" +
+				"z=F(1,\n" +
+				"2);\n" +
+				"}\n" +
+				"}\n",
+		},
+	}
+	for _, test := range tests {
+		for _, eol := range []string{"\n", "\r\n"} {
+			in := strings.Replace(src, "\n", eol, -1)
+			want := strings.Replace(test.want, "\n", eol, -1)
+			got, err := Range([]byte(in), test.first, test.last, Options{Filename: "test.ws"})
+			if err != nil {
+				t.Errorf("%s %q: %v", test.name, eol, err)
+				continue
+			}
+			if string(got) != want {
+				t.Errorf("%s %q: Range(%d, %d) =\n%q\nwant\n%q", test.name, eol, test.first, test.last, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package format
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"timmy.narnian.us/git/timmy/wsfmt/diff"
+	"timmy.narnian.us/git/timmy/wsfmt/text/lex"
+)
+
+// VerifyError describes a formatting result that does not match its
+// source.
+type VerifyError struct {
+	Pos    lex.Position // position in the source
+	OutPos lex.Position // position in the formatted result
+	Msg    string
+}
+
+func (e *VerifyError) Error() string {
+	if e.OutPos == e.Pos {
+		return fmt.Sprintf("%s: %s", e.Pos, e.Msg)
+	}
+	return fmt.Sprintf("%s: %s (formatted %d:%d)", e.Pos, e.Msg, e.OutPos.Line, e.OutPos.Column)
+}
+
+// Verify checks that out, the result of formatting src with opts, has the
+// same tokens as src and that formatting out again does not change it.
+// Space, newlines and carriage returns inside comments are not
+// significant.
+func Verify(src, out []byte, opts Options) error {
+	if err := VerifyTokens(src, out, opts); err != nil {
+		return err
+	}
+	outText, _, _, err := Decode(out)
+	if err != nil {
+		return err
+	}
+	again, err := Source(out, opts)
+	if err != nil {
+		return fmt.Errorf("formatting the result again: %v", err)
+	}
+	if !bytes.Equal(again, out) {
+		againText, _, _, _ := Decode(again)
+		a, b := diff.Lines(outText), diff.Lines(againText)
+		line := 1
+		for _, e := range diff.Diff(len(a), len(b), func(i, j int) bool { return a[i] == b[j] }) {
+			if e.Op != diff.Equal {
+				line = e.A + 1
+				break
+			}
+		}
+		pos := lex.Position{Filename: opts.Filename, Line: line, Column: 1}
+		return &VerifyError{Pos: pos, OutPos: pos, Msg: "formatting the result again changes it"}
+	}
+	return nil
+}
+
+// VerifyTokens checks that out has the same tokens as src. Unlike Verify
+// it does not format out again, so it also applies to the result of
+// Range.
+func VerifyTokens(src, out []byte, opts Options) error {
+	text, _, _, err := Decode(src)
+	if err != nil {
+		return err
+	}
+	outText, _, _, err := Decode(out)
+	if err != nil {
+		return err
+	}
+
+	l1 := lex.Lex(opts.Filename, text)
+	l2 := lex.Lex(opts.Filename, outText)
+	defer l1.Close()
+	defer l2.Close()
+	for {
+		t1, t2 := nextToken(l1), nextToken(l2)
+		if !t1.Same(t2) {
+			return &VerifyError{
+				Pos:    l1.Position(t1),
+				OutPos: l2.Position(t2),
+				Msg:    fmt.Sprintf("token %s changed to %s", describe(t1), describe(t2)),
+			}
+		}
+		if t1.Typ == lex.ItemEOF || t1.Typ == lex.ItemError {
+			break
+		}
+	}
+	return nil
+}
+
+// nextToken returns the next item of l that is not space or a newline.
+func nextToken(l *lex.Lexer) lex.Item {
+	t := l.NextItem()
+	for t.Typ == lex.ItemSpace || t.Typ == lex.ItemNewline {
+		t = l.NextItem()
+	}
+	return t
+}
+
+// describe returns a short description of t for error messages.
+func describe(t lex.Item) string {
+	switch t.Typ {
+	case lex.ItemEOF:
+		return "EOF"
+	case lex.ItemError:
+		return fmt.Sprintf("error %q", t.Val)
+	}
+	return fmt.Sprintf("%s %q", kindName(t.Typ), strings.TrimRight(t.Val, "\r"))
+}
@@ -0,0 +1,225 @@
+package format
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"timmy.narnian.us/git/timmy/wsfmt/text/lex"
+)
+
+// tabWidth is the number of columns a tab counts for when measuring lines.
+const tabWidth = 4
+
+// Break classes, in order of preference. A line is broken at the least
+// nested candidates of the most preferred class it contains.
+const (
+	breakNone  = iota
+	breakComma // after a ',' or a ';' inside parentheses
+	breakOr    // after ||
+	breakAnd   // after &&
+	breakSum   // after a binary + or -
+)
+
+// wrapToken is a token of a line being wrapped.
+type wrapToken struct {
+	lex.Item
+	depth int // number of enclosing parentheses and brackets
+	class int // break class of a break after this token
+}
+
+// wrapper breaks lines that are wider than width.
+type wrapper struct {
+	text  string // the formatted source
+	width int
+	cont  string // extra indentation of continuation lines
+}
+
+// wrap breaks the lines of out that are wider than opts.Width at argument,
+// parameter and operator boundaries. Continuation lines are indented two
+// levels deeper than the line they continue, so they stand apart from a
+// block body. Lines that fit, and lines containing comments, are left
+// untouched.
+func wrap(out []byte, opts Options) []byte {
+	if opts.Width <= 0 {
+		return out
+	}
+	w := &wrapper{
+		text:  string(out),
+		width: opts.Width,
+		cont:  strings.Repeat(opts.Indent.Text(), 2),
+	}
+
+	var (
+		l     = lex.Lex(opts.Filename, w.text)
+		lines = make(map[int][]lex.Item)
+		skip  = make(map[int]bool)
+	)
+	for t := l.NextItem(); t.Typ != lex.ItemEOF; t = l.NextItem() {
+		switch t.Typ {
+		case lex.ItemError:
+			l.Close()
+			return out
+		case lex.ItemSpace, lex.ItemNewline:
+			continue
+		case lex.ItemComment:
+			for i := 0; i <= strings.Count(t.Val, "\n"); i++ {
+				skip[t.Line+i] = true
+			}
+		}
+		lines[t.Line] = append(lines[t.Line], t)
+	}
+	l.Close()
+
+	var b strings.Builder
+	for i, line := range strings.SplitAfter(w.text, "\n") {
+		toks, ok := lines[i+1]
+		if !ok || skip[i+1] || w.columns(strings.TrimSuffix(line, "\n")) <= w.width {
+			b.WriteString(line)
+			continue
+		}
+		indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		for j, piece := range w.split(classify(toks), w.columns(indent), w.columns(indent+w.cont)) {
+			if j > 0 {
+				b.WriteString("\n" + indent + w.cont)
+			} else {
+				b.WriteString(indent)
+			}
+			b.WriteString(w.source(piece))
+		}
+		if strings.HasSuffix(line, "\n") {
+			b.WriteString("\n")
+		}
+	}
+	return []byte(b.String())
+}
+
+// classify returns the tokens of a line with their nesting depth and break
+// class.
+func classify(items []lex.Item) []wrapToken {
+	toks := make([]wrapToken, len(items))
+	depth := 0
+	for i, t := range items {
+		if (t.Typ == lex.ItemRightParen || t.Typ == lex.ItemRightBracket) && depth > 0 {
+			depth--
+		}
+		toks[i] = wrapToken{Item: t, depth: depth}
+		switch {
+		case t.Typ == lex.ItemLeftParen, t.Typ == lex.ItemLeftBracket:
+			depth++
+		case t.Val == ",", t.Val == ";" && depth > 0:
+			toks[i].class = breakComma
+		case t.Typ == lex.ItemLogicalOr:
+			toks[i].class = breakOr
+		case t.Typ == lex.ItemLogicalAnd:
+			toks[i].class = breakAnd
+		case (t.Typ == lex.ItemAdd || t.Typ == lex.ItemSub) && i > 0 && isOperand(items[i-1]):
+			toks[i].class = breakSum
+		}
+	}
+	return toks
+}
+
+// isOperand reports whether t can end an operand, so that a following +
+// or - is a binary operator.
+func isOperand(t lex.Item) bool {
+	switch t.Typ {
+	case lex.ItemIdentifier, lex.ItemNumber, lex.ItemString, lex.ItemName, lex.ItemBool, lex.ItemRightParen, lex.ItemRightBracket:
+		return true
+	}
+	return false
+}
+
+// split breaks toks into pieces that fit in the width when the first piece
+// starts at column first and the others at column cont. It breaks at the
+// least nested candidates of the most preferred class, filling each piece
+// as far as it fits, then splits any piece that is still too wide the same
+// way. A piece without candidates is broken after an opening parenthesis.
+func (w *wrapper) split(toks []wrapToken, first, cont int) [][]wrapToken {
+	if w.fits(toks, first) {
+		return [][]wrapToken{toks}
+	}
+	depth, class := -1, breakNone
+	for _, t := range toks[:len(toks)-1] {
+		if t.class != breakNone && (depth < 0 || t.depth < depth || t.depth == depth && t.class < class) {
+			depth, class = t.depth, t.class
+		}
+	}
+	if depth < 0 {
+		return w.splitParen(toks, cont)
+	}
+
+	var (
+		pieces [][]wrapToken
+		start  = 0
+		col    = first
+		brk    = -1
+	)
+	cut := func() {
+		pieces = append(pieces, toks[start:brk+1])
+		start, col, brk = brk+1, cont, -1
+	}
+	for i, t := range toks[:len(toks)-1] {
+		if t.depth != depth || t.class != class {
+			continue
+		}
+		if brk >= 0 && !w.fits(toks[start:i+1], col) {
+			cut()
+		}
+		brk = i
+	}
+	if brk >= 0 && !w.fits(toks[start:], col) {
+		cut()
+	}
+	pieces = append(pieces, toks[start:])
+	if len(pieces) == 1 {
+		return pieces
+	}
+
+	var res [][]wrapToken
+	for i, p := range pieces {
+		col := cont
+		if i == 0 {
+			col = first
+		}
+		res = append(res, w.split(p, col, cont)...)
+	}
+	return res
+}
+
+// splitParen breaks toks, which have no break candidates, after their
+// least nested opening parenthesis or bracket that is not empty, and
+// splits the rest as a continuation. It leaves toks whole if there is no
+// such parenthesis.
+func (w *wrapper) splitParen(toks []wrapToken, cont int) [][]wrapToken {
+	at := -1
+	for i, t := range toks[:len(toks)-1] {
+		if t.Typ != lex.ItemLeftParen && t.Typ != lex.ItemLeftBracket {
+			continue
+		}
+		if next := toks[i+1].Typ; next == lex.ItemRightParen || next == lex.ItemRightBracket {
+			continue
+		}
+		if at < 0 || t.depth < toks[at].depth {
+			at = i
+		}
+	}
+	if at < 0 {
+		return [][]wrapToken{toks}
+	}
+	return append([][]wrapToken{toks[:at+1]}, w.split(toks[at+1:], cont, cont)...)
+}
+
+// source returns the text of toks as it appears in the formatted source.
+func (w *wrapper) source(toks []wrapToken) string {
+	return w.text[toks[0].Pos:toks[len(toks)-1].End]
+}
+
+// fits reports whether toks fit in the width starting at column col.
+func (w *wrapper) fits(toks []wrapToken, col int) bool {
+	return col+w.columns(w.source(toks)) <= w.width
+}
+
+// columns returns the width of s, counting tabs as tabWidth columns.
+func (w *wrapper) columns(s string) int {
+	return utf8.RuneCountInString(s) + strings.Count(s, "\t")*(tabWidth-1)
+}
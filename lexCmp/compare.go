@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+
+	"timmy.narnian.us/git/timmy/wsfmt/diff"
+	"timmy.narnian.us/git/timmy/wsfmt/text/lex"
+)
+
+type status int
+
+const (
+	statusNone      status = iota // directories that match; not reported
+	statusIdentical               // the files have the same tokens
+	statusMismatch                // the tokens differ
+	statusMissing                 // the modified file does not exist or cannot be read
+	statusDirFile                 // one path is a directory and the other a file
+	statusLexError                // either file does not lex
+)
+
+// result is the outcome of comparing one original path with its modified
+// counterpart.
+type result struct {
+	Original string
+	Modified string
+	Status   status
+	Err      error
+	Hunks    []hunk
+
+	pending bool // the files still have to be compared
+}
+
+// hunk is a run of differing tokens with unchanged tokens around it.
+type hunk []edit
+
+// edit is one token of a hunk. Orig or Mod is nil for inserted and
+// deleted tokens.
+type edit struct {
+	Op   diff.Op
+	Orig *token
+	Mod  *token
+}
+
+// token is a significant item with its position.
+type token struct {
+	lex.Item
+	Pos lex.Position
+}
+
+// tokens returns the significant tokens of the file, ending with EOF or
+// an error item.
+func tokens(file string) ([]token, error) {
+	l, err := Lex(file)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+	var toks []token
+	for {
+		t := next(l)
+		toks = append(toks, token{t, l.Position(t)})
+		if t.Typ == lex.ItemEOF || t.Typ == lex.ItemError {
+			return toks, nil
+		}
+	}
+}
+
+// compare compares the tokens of r.Original and r.Modified.
+func compare(r *result) {
+	orig, err := tokens(r.Original)
+	if err != nil {
+		r.Status, r.Err = statusMissing, err
+		return
+	}
+	mod, err := tokens(r.Modified)
+	if err != nil {
+		r.Status, r.Err = statusMissing, err
+		return
+	}
+	for _, toks := range [][]token{orig, mod} {
+		if t := toks[len(toks)-1]; t.Typ == lex.ItemError {
+			r.Status, r.Err = statusLexError, fmt.Errorf("%s: %s", t.Pos, t.Val)
+			return
+		}
+	}
+
+	orig, mod = rules.filter(orig), rules.filter(mod)
+	edits := diff.Diff(len(orig), len(mod), func(i, j int) bool {
+		return rules.same(orig[i].Item, mod[j].Item)
+	})
+	for _, h := range diff.Hunks(edits, args.Context) {
+		var hk hunk
+		for _, e := range h.Edits {
+			var ed edit
+			ed.Op = e.Op
+			if e.Op != diff.Insert {
+				ed.Orig = &orig[e.A]
+			}
+			if e.Op != diff.Delete {
+				ed.Mod = &mod[e.B]
+			}
+			hk = append(hk, ed)
+		}
+		r.Hunks = append(r.Hunks, hk)
+	}
+	r.Status = statusIdentical
+	if len(r.Hunks) > 0 {
+		r.Status = statusMismatch
+	}
+}
+
+// summary counts results by status.
+type summary map[status]int
+
+func (s summary) add(r *result) {
+	s[r.Status]++
+}
+
+func (s summary) ok() bool {
+	return s[statusMismatch]+s[statusMissing]+s[statusDirFile]+s[statusLexError] == 0
+}
+
+var statusNames = map[status]string{
+	statusNone:      "none",
+	statusIdentical: "identical",
+	statusMismatch:  "mismatch",
+	statusMissing:   "missing",
+	statusDirFile:   "dir-file-mismatch",
+	statusLexError:  "lex-error",
+}
+
+func (s status) String() string {
+	return statusNames[s]
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (s status) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// firstMismatch returns the first tokens that differ between the files.
+// When a token was only deleted or only inserted, the other token is the
+// one that follows it on the other side.
+func (r *result) firstMismatch() (orig, mod *token) {
+	if len(r.Hunks) == 0 {
+		return nil, nil
+	}
+	h := r.Hunks[0]
+	for i, e := range h {
+		if e.Op == diff.Equal {
+			continue
+		}
+		orig, mod = e.Orig, e.Mod
+		for _, f := range h[i+1:] {
+			if orig == nil {
+				orig = f.Orig
+			}
+			if mod == nil {
+				mod = f.Mod
+			}
+		}
+		return orig, mod
+	}
+	return nil, nil
+}
@@ -2,136 +2,116 @@ package main
 
 import (
 	"fmt"
-	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 
 	"github.com/alexflint/go-arg"
 
-	"golang.org/x/text/encoding/unicode"
-	"golang.org/x/text/transform"
-
+	"timmy.narnian.us/git/timmy/wsfmt/format"
 	"timmy.narnian.us/git/timmy/wsfmt/text/lex"
 )
 
-var (
-	args struct {
-		ORIG     string `arg:"required,positional,help:Directory or file containing original files"`
-		MODIFIED string `arg:"required,positional,help:Directory or file containing modified files e.g. reformatted files"`
-	}
-	original string
-	modified string
-)
+var args struct {
+	ORIG     string `arg:"required,positional,help:Directory or file containing original files"`
+	MODIFIED string `arg:"required,positional,help:Directory or file containing modified files e.g. reformatted files"`
+	Context  int    `arg:"help:Number of unchanged tokens shown around each difference"`
+	Format   string `arg:"help:Report format (text|json|junit)"`
+	Jobs     int    `arg:"-j,help:Number of file pairs compared concurrently"`
+	FailFast bool   `arg:"--fail-fast,help:Stop at the first file pair that does not match"`
+	Rules    string `arg:"help:TOML file of allowed differences between the files"`
+}
+
+// rules are the allowed differences; none unless --rules is given.
+var rules = &ruleSet{}
 
 func main() {
-	arg.MustParse(&args)
+	args.Context = 3
+	args.Format = "text"
+	args.Jobs = runtime.NumCPU()
+	p := arg.MustParse(&args)
+	report, ok := reporters[args.Format]
+	if !ok {
+		p.Fail("--format must be text, json or junit")
+	}
+	if args.Jobs < 1 {
+		p.Fail("-j must be at least 1")
+	}
+	if args.Rules != "" {
+		var err error
+		if rules, err = loadRules(args.Rules); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
 	args.MODIFIED = filepath.Clean(args.MODIFIED)
 	args.ORIG = filepath.Clean(args.ORIG)
 
-	filepath.Walk(args.ORIG, func(path string, info os.FileInfo, err error) error {
-
-		original = path
-		modified = filepath.Join(args.MODIFIED, strings.TrimPrefix(path, args.ORIG))
+	var results []*result
+	filepath.Walk(args.ORIG, func(original string, info os.FileInfo, err error) error {
+		modified := filepath.Join(args.MODIFIED, strings.TrimPrefix(original, args.ORIG))
+		r := &result{Original: original, Modified: modified}
+		defer func() {
+			if r.Status != statusNone || r.pending {
+				results = append(results, r)
+			}
+		}()
 
 		if err != nil {
-			fmt.Println(err)
-			if info.IsDir() {
+			r.Status, r.Err = statusMissing, err
+			if info != nil && info.IsDir() {
 				return filepath.SkipDir
 			}
 			return nil
 		}
-
 		in, err := os.Stat(modified)
 		if err != nil {
-			fmt.Println(err)
+			r.Status, r.Err = statusMissing, err
 			if info.IsDir() {
 				return filepath.SkipDir
 			}
 			return nil
 		}
 		if in.IsDir() != info.IsDir() {
-			var (
-				dir  = modified
-				file = original
-			)
+			r.Status = statusDirFile
 			if info.IsDir() {
-				dir, file = file, dir
-				fmt.Printf("File directory mismatch: Directory: %q File: %q\n", dir, file)
 				return filepath.SkipDir
 			}
-			fmt.Printf("File directory mismatch: Directory: %q File: %q\n", dir, file)
 			return nil
 		}
 		if info.IsDir() {
 			return nil
 		}
-		origL, err := Lex(original)
-		if err != nil {
-			fmt.Println(err)
-			return nil
-		}
-		modL, err := Lex(modified)
-		if err != nil {
-			fmt.Println(err)
-			return nil
-		}
-		if !cmp(origL, modL) {
-			os.Exit(3)
-		}
+		r.pending = true
 		return nil
 	})
-}
-
-func cmp(l *lex.Lexer, l2 *lex.Lexer) bool {
-	for Continue := true; Continue; {
-		var (
-			lItem  = next(l)
-			l2Item = next(l2)
-		)
-		if lItem.Typ == l2Item.Typ {
-			switch lItem.Typ {
-			case lex.ItemIdentifier, lex.ItemChar, lex.ItemCharConstant, lex.ItemString, lex.ItemBool, lex.ItemComment, lex.ItemModifiers, lex.ItemNumber, lex.ItemOperator:
-				if strings.Replace(lItem.Val, "\r", "", -1) != strings.Replace(l2Item.Val, "\r", "", -1) {
-					fmt.Printf("Value mismatch %s: %s is not %s: %s\n", original, lItem, modified, l2Item)
-					return false
-				}
-			}
-		} else {
-			fmt.Printf("Value mismatch %s: %s is not %s: %s\n", original, lItem, modified, l2Item)
-			return false
-		}
-		if lItem.Typ == lex.ItemEOF {
-			Continue = false
-		}
-		if lItem.Typ == lex.ItemError {
-			fmt.Println(lItem)
-		}
-		if l2Item.Typ == lex.ItemError {
-			fmt.Println(l2Item)
-		}
+	results = compareAll(results, args.Jobs, args.FailFast)
+	sum := summary{}
+	for _, r := range results {
+		sum.add(r)
+	}
+	if err := report(os.Stdout, results, sum); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if !sum.ok() {
+		os.Exit(3)
 	}
-	return true
 }
 
+// Lex returns a lexer for file, which may be UTF-8 or UTF-16.
 func Lex(file string) (*lex.Lexer, error) {
-	var (
-		err  error
-		b    []byte
-		text io.Reader
-	)
-	text, err = os.Open(file)
+	b, err := ioutil.ReadFile(file)
 	if err != nil {
-		fmt.Println(err)
 		return lex.Lex("fail", string("Fail")), err
 	}
-	FILE := transform.NewReader(text, unicode.BOMOverride(unicode.UTF8.NewDecoder().Transformer))
-	b, err = ioutil.ReadAll(FILE)
+	text, _, _, err := format.Decode(b)
 	if err != nil {
 		return lex.Lex("fail", string("Fail")), err
 	}
-	return lex.Lex(file, string(b)), nil
+	return lex.Lex(file, text), nil
 }
 
 func next(l *lex.Lexer) lex.Item {
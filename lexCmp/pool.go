@@ -0,0 +1,63 @@
+package main
+
+import "sync"
+
+// compareAll compares the pending file pairs of results using jobs
+// workers and returns results. With failFast, no pair after the first
+// failure in path order is compared and those results are dropped, so the
+// report is the same whatever order the workers finish in.
+func compareAll(results []*result, jobs int, failFast bool) []*result {
+	var (
+		mu     sync.Mutex
+		failAt = len(results) // index of the first failure
+		work   = make(chan int)
+		wg     sync.WaitGroup
+	)
+	failed := func(i int) {
+		mu.Lock()
+		if i < failAt {
+			failAt = i
+		}
+		mu.Unlock()
+	}
+	stopped := func(i int) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return failFast && i > failAt
+	}
+
+	for i, r := range results {
+		if !r.pending && r.Status != statusIdentical {
+			failed(i)
+		}
+	}
+	for w := 0; w < jobs; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				if stopped(i) {
+					continue
+				}
+				r := results[i]
+				compare(r)
+				r.pending = false
+				if r.Status != statusIdentical {
+					failed(i)
+				}
+			}
+		}()
+	}
+	for i, r := range results {
+		if r.pending && !stopped(i) {
+			work <- i
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	if failFast && failAt < len(results) {
+		results = results[:failAt+1]
+	}
+	return results
+}
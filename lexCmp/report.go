@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+
+	"timmy.narnian.us/git/timmy/wsfmt/diff"
+	"timmy.narnian.us/git/timmy/wsfmt/text/lex"
+)
+
+// A reporter writes the results of a comparison in one format.
+type reporter func(w io.Writer, results []*result, sum summary) error
+
+var reporters = map[string]reporter{
+	"text":  reportText,
+	"json":  reportJSON,
+	"junit": reportJUnit,
+}
+
+// ----------------------------------------------------------------------------
+// Text
+
+func reportText(w io.Writer, results []*result, sum summary) error {
+	for _, r := range results {
+		r.print(w)
+	}
+	sum.print(w)
+	return nil
+}
+
+// print writes a report of r, unless the files are identical.
+func (r *result) print(w io.Writer) {
+	switch r.Status {
+	case statusMissing:
+		fmt.Fprintf(w, "Missing: %v\n", r.Err)
+	case statusDirFile:
+		fmt.Fprintf(w, "File directory mismatch: %q %q\n", r.Original, r.Modified)
+	case statusLexError:
+		fmt.Fprintf(w, "Lex error: %v\n", r.Err)
+	case statusMismatch:
+		fmt.Fprintf(w, "Token mismatch: %s %s\n", r.Original, r.Modified)
+		for _, h := range r.Hunks {
+			fmt.Fprintf(w, "@@ %s %s @@\n", h.start(func(e edit) *token { return e.Orig }), h.start(func(e edit) *token { return e.Mod }))
+			for _, e := range h {
+				switch e.Op {
+				case diff.Equal:
+					fmt.Fprintf(w, "  %-9s %-9s %s\n", lineCol(e.Orig), lineCol(e.Mod), describe(e.Orig))
+				case diff.Delete:
+					fmt.Fprintf(w, "- %-9s %-9s %s\n", lineCol(e.Orig), "", describe(e.Orig))
+				case diff.Insert:
+					fmt.Fprintf(w, "+ %-9s %-9s %s\n", "", lineCol(e.Mod), describe(e.Mod))
+				}
+			}
+		}
+	}
+}
+
+// start returns the position of the first token of h on one side.
+func (h hunk) start(side func(edit) *token) string {
+	for _, e := range h {
+		if t := side(e); t != nil {
+			return t.Pos.String()
+		}
+	}
+	return "-"
+}
+
+func lineCol(t *token) string {
+	return fmt.Sprintf("%d:%d", t.Pos.Line, t.Pos.Column)
+}
+
+// kind returns the name of the token kind of t.
+func kind(t lex.Item) string {
+	if name, ok := lex.Rkey[t.Typ]; ok {
+		return name
+	}
+	return fmt.Sprintf("item(%d)", int(t.Typ))
+}
+
+func describe(t *token) string {
+	if t.Typ == lex.ItemEOF {
+		return "EOF"
+	}
+	return fmt.Sprintf("%s %q", kind(t.Item), t.Val)
+}
+
+func (s summary) compared() int {
+	return s[statusIdentical] + s[statusMismatch] + s[statusLexError]
+}
+
+func (s summary) print(w io.Writer) {
+	fmt.Fprintf(w, "%d files compared: %d identical, %d mismatched, %d missing, %d directory/file mismatches, %d lex errors\n",
+		s.compared(), s[statusIdentical], s[statusMismatch], s[statusMissing], s[statusDirFile], s[statusLexError])
+}
+
+// ----------------------------------------------------------------------------
+// JSON
+
+type jsonReport struct {
+	Files   []jsonFile  `json:"files"`
+	Summary jsonSummary `json:"summary"`
+}
+
+type jsonFile struct {
+	Original      string        `json:"original"`
+	Modified      string        `json:"modified"`
+	Status        status        `json:"status"`
+	Error         string        `json:"error,omitempty"`
+	FirstMismatch *jsonMismatch `json:"firstMismatch,omitempty"`
+}
+
+type jsonMismatch struct {
+	Original *jsonToken `json:"original"`
+	Modified *jsonToken `json:"modified"`
+}
+
+type jsonToken struct {
+	Line   int    `json:"line"`
+	Column int    `json:"column"`
+	Kind   string `json:"kind"`
+	Value  string `json:"value"`
+}
+
+type jsonSummary struct {
+	Compared   int `json:"compared"`
+	Identical  int `json:"identical"`
+	Mismatched int `json:"mismatched"`
+	Missing    int `json:"missing"`
+	DirFile    int `json:"dirFileMismatches"`
+	LexErrors  int `json:"lexErrors"`
+}
+
+func newJSONToken(t *token) *jsonToken {
+	if t == nil {
+		return nil
+	}
+	return &jsonToken{Line: t.Pos.Line, Column: t.Pos.Column, Kind: kind(t.Item), Value: t.Val}
+}
+
+func reportJSON(w io.Writer, results []*result, sum summary) error {
+	rep := jsonReport{
+		Files: []jsonFile{},
+		Summary: jsonSummary{
+			Compared:   sum.compared(),
+			Identical:  sum[statusIdentical],
+			Mismatched: sum[statusMismatch],
+			Missing:    sum[statusMissing],
+			DirFile:    sum[statusDirFile],
+			LexErrors:  sum[statusLexError],
+		},
+	}
+	for _, r := range results {
+		f := jsonFile{Original: r.Original, Modified: r.Modified, Status: r.Status}
+		if r.Err != nil {
+			f.Error = r.Err.Error()
+		}
+		if orig, mod := r.firstMismatch(); orig != nil || mod != nil {
+			f.FirstMismatch = &jsonMismatch{Original: newJSONToken(orig), Modified: newJSONToken(mod)}
+		}
+		rep.Files = append(rep.Files, f)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(rep)
+}
+
+// ----------------------------------------------------------------------------
+// JUnit
+
+type junitSuites struct {
+	XMLName xml.Name     `xml:"testsuites"`
+	Suites  []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Errors   int         `xml:"errors,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Classname string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Failure   *junitProblem `xml:"failure,omitempty"`
+	Error     *junitProblem `xml:"error,omitempty"`
+}
+
+type junitProblem struct {
+	Type    string `xml:"type,attr"`
+	Message string `xml:"message,attr"`
+	Body    string `xml:",chardata"`
+}
+
+// reportJUnit writes one test case per file pair. Token mismatches are
+// failures; missing files, directory/file mismatches and lex errors are
+// errors.
+func reportJUnit(w io.Writer, results []*result, sum summary) error {
+	suite := junitSuite{Name: "lexCmp", Tests: len(results)}
+	for _, r := range results {
+		c := junitCase{Classname: "lexCmp", Name: r.Original}
+		switch r.Status {
+		case statusMismatch:
+			orig, mod := r.firstMismatch()
+			msg := fmt.Sprintf("%s is not %s", mismatchSide(orig), mismatchSide(mod))
+			var body strings.Builder
+			r.print(&body)
+			c.Failure = &junitProblem{Type: r.Status.String(), Message: msg, Body: body.String()}
+			suite.Failures++
+		case statusMissing, statusLexError:
+			c.Error = &junitProblem{Type: r.Status.String(), Message: r.Err.Error()}
+			suite.Errors++
+		case statusDirFile:
+			msg := fmt.Sprintf("%s and %s are not both files or both directories", r.Original, r.Modified)
+			c.Error = &junitProblem{Type: r.Status.String(), Message: msg}
+			suite.Errors++
+		}
+		suite.Cases = append(suite.Cases, c)
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	if err := enc.Encode(junitSuites{Suites: []junitSuite{suite}}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// mismatchSide describes one side of a mismatch with its position.
+func mismatchSide(t *token) string {
+	if t == nil {
+		return "nothing"
+	}
+	return fmt.Sprintf("%s: %s", t.Pos, describe(t))
+}
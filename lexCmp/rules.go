@@ -0,0 +1,336 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+
+	"timmy.narnian.us/git/timmy/wsfmt/text/lex"
+)
+
+// ruleSet declares which differences between two token streams are
+// allowed. The zero value allows none.
+//
+// A rule file is TOML:
+//
+//	# built-in rules
+//	rules = ["float-suffix", "comment-whitespace", "semicolon-after-brace", "grouping-parens", "name-case"]
+//
+//	# tokens whose values are interchangeable; kind, a name from
+//	# lex.Rkey, limits the alias to tokens of that kind
+//	[[alias]]
+//	values = ["NULL", "null"]
+type ruleSet struct {
+	floatSuffix    bool // 1.0f is 1.0
+	commentSpace   bool // comments differing only in white space are equal
+	semiAfterBrace bool // a ; right after } may be added or removed
+	groupingParens bool // parentheses that do not change the parse may be added or removed
+	nameCase       bool // names differing only in case are equal, as in the game
+
+	aliases map[lex.ItemType]map[string]int // value to alias group, by kind; anyKind for all kinds
+}
+
+// anyKind is the aliases key of aliases without a kind.
+const anyKind lex.ItemType = -1
+
+var ruleNames = map[string]func(*ruleSet){
+	"float-suffix":          func(r *ruleSet) { r.floatSuffix = true },
+	"comment-whitespace":    func(r *ruleSet) { r.commentSpace = true },
+	"semicolon-after-brace": func(r *ruleSet) { r.semiAfterBrace = true },
+	"grouping-parens":       func(r *ruleSet) { r.groupingParens = true },
+	"name-case":             func(r *ruleSet) { r.nameCase = true },
+}
+
+// loadRules reads a rule file.
+func loadRules(file string) (*ruleSet, error) {
+	var f struct {
+		Rules []string `toml:"rules"`
+		Alias []struct {
+			Kind   string   `toml:"kind"`
+			Values []string `toml:"values"`
+		} `toml:"alias"`
+	}
+	md, err := toml.DecodeFile(file, &f)
+	if err != nil {
+		return nil, err
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("%s: unknown setting %s", file, undecoded[0])
+	}
+
+	r := &ruleSet{aliases: make(map[lex.ItemType]map[string]int)}
+	for _, name := range f.Rules {
+		set, ok := ruleNames[name]
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown rule %q", file, name)
+		}
+		set(r)
+	}
+	for i, a := range f.Alias {
+		typ, ok := anyKind, true
+		if a.Kind != "" {
+			typ, ok = kindType(a.Kind)
+			typ = aliasKind(typ)
+		}
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown token kind %q", file, a.Kind)
+		}
+		if r.aliases[typ] == nil {
+			r.aliases[typ] = make(map[string]int)
+		}
+		for _, v := range a.Values {
+			r.aliases[typ][v] = i
+		}
+	}
+	return r, nil
+}
+
+// kindType returns the item type named name in lex.Rkey.
+func kindType(name string) (lex.ItemType, bool) {
+	for typ, n := range lex.Rkey {
+		if n == name {
+			return typ, true
+		}
+	}
+	return 0, false
+}
+
+// aliasKind returns the kind the aliases of tokens of type t are listed
+// under. All operators share the kind "operator".
+func aliasKind(t lex.ItemType) lex.ItemType {
+	if t.IsOperator() {
+		return lex.ItemOperator
+	}
+	return t
+}
+
+// same reports whether a and b are equal tokens under r.
+func (r *ruleSet) same(a, b lex.Item) bool {
+	if a.Same(b) {
+		return true
+	}
+	ka, kb := aliasKind(a.Typ), aliasKind(b.Typ)
+	for _, typ := range []lex.ItemType{ka, anyKind} {
+		if typ != anyKind && ka != kb {
+			continue
+		}
+		g, ok1 := r.aliases[typ][a.Val]
+		h, ok2 := r.aliases[typ][b.Val]
+		if ok1 && ok2 && g == h {
+			return true
+		}
+	}
+	if a.Typ != b.Typ {
+		return false
+	}
+	switch {
+	case a.Typ == lex.ItemNumber && r.floatSuffix:
+		return trimFloatSuffix(a.Val) == trimFloatSuffix(b.Val)
+	case a.Typ == lex.ItemComment && r.commentSpace:
+		return strings.Join(strings.Fields(a.Val), " ") == strings.Join(strings.Fields(b.Val), " ")
+	case a.Typ == lex.ItemName && r.nameCase:
+		return strings.EqualFold(a.Val, b.Val)
+	}
+	return false
+}
+
+// trimFloatSuffix removes the f or F that may end a decimal number. The f
+// of a hex number is a digit.
+func trimFloatSuffix(s string) string {
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		return s
+	}
+	if n := len(s); n > 1 && (s[n-1] == 'f' || s[n-1] == 'F') {
+		return s[:n-1]
+	}
+	return s
+}
+
+// filter removes the tokens that the rules allow to be added or removed.
+func (r *ruleSet) filter(toks []token) []token {
+	if !r.semiAfterBrace && !r.groupingParens {
+		return toks
+	}
+	var drop []bool
+	if r.groupingParens {
+		drop = redundantParens(toks)
+	}
+	var out []token
+	for i, t := range toks {
+		switch {
+		case r.semiAfterBrace && t.Val == ";" && i > 0 && toks[i-1].Typ == lex.ItemRightBrace:
+			continue
+		case drop != nil && drop[i]:
+			continue
+		}
+		out = append(out, t)
+	}
+	return out
+}
+
+// How tightly an expression holds together, extending the precedences of
+// the binary operators, 1 to 9.
+const (
+	bindAssign  = -1 // a = b
+	bindCond    = 0  // a ? b : c
+	bindUnary   = 10 // -a, !a, ++a
+	bindPrimary = 11 // a, a.b, f(a), a[i], (a)
+)
+
+// redundantParens marks the grouping parentheses in toks that can be
+// removed without changing how the expression parses. Pairs are
+// considered outermost first, each in the context left by the pairs
+// already removed, so that one pair of ((a + b)) * c stays.
+func redundantParens(toks []token) []bool {
+	drop := make([]bool, len(toks))
+	match := make([]int, len(toks)) // for each (, the index of its )
+	var open []int
+	for i, t := range toks {
+		match[i] = -1
+		switch t.Typ {
+		case lex.ItemLeftParen:
+			open = append(open, i)
+		case lex.ItemRightParen:
+			if n := len(open); n > 0 {
+				match[open[n-1]] = i
+				open = open[:n-1]
+			}
+		}
+	}
+	for i, t := range toks {
+		end := match[i]
+		if t.Typ != lex.ItemLeftParen || end < 0 {
+			continue
+		}
+		prev, next := neighbor(toks, drop, i, -1), neighbor(toks, drop, end, 1)
+		if prev < 0 || next < 0 || !isGroupingContext(toks[prev].Item) {
+			continue
+		}
+		b := binding(toks[i+1 : end])
+		if b > bindAssign && b >= leftBinding(toks, drop, prev) && b >= rightBinding(toks[next].Item) {
+			drop[i], drop[end] = true, true
+		}
+	}
+	return drop
+}
+
+// neighbor returns the index of the token before (dir -1) or after (dir 1)
+// toks[i], skipping comments and dropped tokens, or -1 if there is none.
+func neighbor(toks []token, drop []bool, i, dir int) int {
+	for i += dir; i >= 0 && i < len(toks); i += dir {
+		if !drop[i] && toks[i].Typ != lex.ItemComment {
+			return i
+		}
+	}
+	return -1
+}
+
+// binding returns how tightly the expression toks holds together: the
+// loosest of its outermost operators.
+func binding(toks []token) int {
+	b, depth, operand := bindPrimary, 0, false
+	for _, t := range toks {
+		if t.Typ == lex.ItemComment {
+			continue
+		}
+		op := bindPrimary
+		switch {
+		case t.Typ == lex.ItemLeftParen || t.Typ == lex.ItemLeftBracket:
+			depth++
+		case t.Typ == lex.ItemRightParen || t.Typ == lex.ItemRightBracket:
+			depth--
+		case depth > 0:
+		case t.Typ == lex.ItemQuestion || t.Typ == lex.ItemColon:
+			op = bindCond
+		case isAssign(t.Typ):
+			op = bindAssign
+		case operand && t.Typ.Precedence() > 0:
+			op = t.Typ.Precedence()
+		case !operand && t.Typ.IsOperator():
+			op = bindUnary
+		}
+		if op < b {
+			b = op
+		}
+		operand = endsOperand(t.Item)
+	}
+	return b
+}
+
+// leftBinding returns how tightly an expression right after toks[prev]
+// must hold together to keep its meaning without parentheses.
+func leftBinding(toks []token, drop []bool, prev int) int {
+	t := toks[prev]
+	switch {
+	case t.Typ == lex.ItemQuestion || t.Typ == lex.ItemColon:
+		return bindCond + 1
+	case !t.Typ.IsOperator() || isAssign(t.Typ):
+		return bindCond
+	}
+	if p := neighbor(toks, drop, prev, -1); p < 0 || !endsOperand(toks[p].Item) {
+		return bindUnary // t is a unary operator
+	}
+	// a binary operator groups to the left, so a - (b - c) keeps its
+	// parentheses
+	return t.Typ.Precedence() + 1
+}
+
+// rightBinding returns how tightly an expression right before next must
+// hold together to keep its meaning without parentheses.
+func rightBinding(next lex.Item) int {
+	switch {
+	case next.Typ == lex.ItemDot, next.Typ == lex.ItemLeftParen, next.Typ == lex.ItemLeftBracket,
+		next.Typ == lex.ItemIncrement, next.Typ == lex.ItemDecrement, isAssign(next.Typ):
+		return bindPrimary
+	case startsOperand(next):
+		// (a) b is a cast
+		return bindPrimary + 1
+	case next.Typ == lex.ItemQuestion || next.Typ == lex.ItemColon:
+		return bindCond + 1
+	case next.Typ.Precedence() > 0:
+		return next.Typ.Precedence()
+	}
+	return bindCond
+}
+
+func isAssign(t lex.ItemType) bool {
+	switch t {
+	case lex.ItemAssign, lex.ItemAddAssign, lex.ItemSubAssign, lex.ItemMulAssign, lex.ItemDivAssign,
+		lex.ItemModAssign, lex.ItemAndAssign, lex.ItemOrAssign:
+		return true
+	}
+	return false
+}
+
+// startsOperand reports whether t can begin an operand that is not a
+// unary or parenthesized expression.
+func startsOperand(t lex.Item) bool {
+	switch t.Typ {
+	case lex.ItemIdentifier, lex.ItemNumber, lex.ItemString, lex.ItemName, lex.ItemBool, lex.ItemNULL,
+		lex.ItemThis, lex.ItemSuper, lex.ItemParent, lex.ItemVirtualParent, lex.ItemNew:
+		return true
+	}
+	return false
+}
+
+// endsOperand reports whether t can end an operand, so that an operator
+// after it is binary or postfix.
+func endsOperand(t lex.Item) bool {
+	switch t.Typ {
+	case lex.ItemRightParen, lex.ItemRightBracket, lex.ItemIncrement, lex.ItemDecrement:
+		return true
+	}
+	return startsOperand(t) && t.Typ != lex.ItemNew
+}
+
+// isGroupingContext reports whether a ( after prev starts a parenthesized
+// expression rather than a call, a parameter list or the condition of a
+// statement.
+func isGroupingContext(prev lex.Item) bool {
+	switch prev.Typ {
+	case lex.ItemLeftParen, lex.ItemLeftBracket, lex.ItemReturn, lex.ItemChar, lex.ItemQuestion, lex.ItemColon:
+		return true
+	}
+	return prev.Typ.IsOperator()
+}
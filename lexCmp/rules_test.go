@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+
+	"timmy.narnian.us/git/timmy/wsfmt/text/lex"
+)
+
+func TestFloatSuffix(t *testing.T) {
+	r := &ruleSet{floatSuffix: true}
+	tests := []struct {
+		a, b string
+		same bool
+	}{
+		{"1.0f", "1.0", true},
+		{"1.5F", "1.5", true},
+		{"2f", "2", true},
+		{"1.0ff", "1.0", false},
+		{"0xFF", "0xF", false},
+		{"0xff", "0xf", false},
+		{"0XF", "0X", false},
+		{"0x1F", "0x1F", true},
+	}
+	for _, test := range tests {
+		a := lex.Item{Typ: lex.ItemNumber, Val: test.a}
+		b := lex.Item{Typ: lex.ItemNumber, Val: test.b}
+		if got := r.same(a, b); got != test.same {
+			t.Errorf("same(%s, %s) = %t, want %t", test.a, test.b, got, test.same)
+		}
+	}
+}
+
+func TestGroupingParens(t *testing.T) {
+	r := &ruleSet{groupingParens: true}
+	tests := []struct {
+		a, b string
+		same bool
+	}{
+		{"x = (a);", "x = a;", true},
+		{"x = (a * b) + c;", "x = a * b + c;", true},
+		{"x = a + (b * c);", "x = a + b * c;", true},
+		{"x = (a - b) - c;", "x = a - b - c;", true},
+		{"x = ((a + b)) * c;", "x = (a + b) * c;", true},
+		{"return (a || b);", "return a || b;", true},
+		{"F((a + b), c);", "F(a + b, c);", true},
+		{"x = -(a);", "x = -a;", true},
+		{"x = (a).b;", "x = a.b;", true},
+		{"x = c ? (a + b) : d;", "x = c ? a + b : d;", true},
+
+		// removing the parentheses changes the parse
+		{"x = (a + b) * c;", "x = a + b * c;", false},
+		{"x = a - (b - c);", "x = a - b - c;", false},
+		{"x = !(a && b);", "x = !a && b;", false},
+		{"x = (-a).b;", "x = -a.b;", false},
+		{"x = (c ? a : b) + d;", "x = c ? a : b + d;", false},
+		{"x = (int)y;", "x = int y;", false},
+
+		// adding them changes it too
+		{"x = a * b + c;", "x = a * (b + c);", false},
+		{"x = a || b && c;", "x = (a || b) && c;", false},
+	}
+	for _, test := range tests {
+		a, b := r.filter(lexTokens(test.a)), r.filter(lexTokens(test.b))
+		got := len(a) == len(b)
+		for i := 0; got && i < len(a); i++ {
+			got = r.same(a[i].Item, b[i].Item)
+		}
+		if got != test.same {
+			t.Errorf("%s and %s: same = %t, want %t", test.a, test.b, got, test.same)
+		}
+	}
+}
+
+// lexTokens returns the significant tokens of src.
+func lexTokens(src string) []token {
+	l := lex.Lex("test.ws", src)
+	defer l.Close()
+	var toks []token
+	for t := next(l); t.Typ != lex.ItemEOF && t.Typ != lex.ItemError; t = next(l) {
+		toks = append(toks, token{Item: t})
+	}
+	return toks
+}
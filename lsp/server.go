@@ -0,0 +1,387 @@
+// Package lsp implements a Language Server Protocol server that formats
+// WitcherScript documents and reports their syntax errors.
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+
+	"timmy.narnian.us/git/timmy/wsfmt/config"
+	"timmy.narnian.us/git/timmy/wsfmt/diff"
+	"timmy.narnian.us/git/timmy/wsfmt/format"
+	"timmy.narnian.us/git/timmy/wsfmt/parser"
+	"timmy.narnian.us/git/timmy/wsfmt/text/lex"
+)
+
+// Server is a language server reading requests from one stream and
+// writing responses and notifications to another. Requests are handled
+// one at a time in the order they arrive.
+type Server struct {
+	in       *bufio.Reader
+	out      io.Writer
+	docs     map[string]string // text of the open documents by URI
+	configs  config.Loader
+	shutdown bool
+}
+
+// NewServer returns a server that reads from in and writes to out.
+func NewServer(in io.Reader, out io.Writer) *Server {
+	return &Server{
+		in:   bufio.NewReader(in),
+		out:  out,
+		docs: make(map[string]string),
+	}
+}
+
+// errExit stops Run after an exit notification.
+var errExit = errors.New("exit")
+
+// Run serves requests until the client sends exit or closes the input. It
+// returns nil if the client shut the server down first.
+func (s *Server) Run() error {
+	for {
+		m, err := readMessage(s.in)
+		if err != nil {
+			if rerr, ok := err.(*responseError); ok {
+				if err := s.reply(nil, nil, rerr); err != nil {
+					return err
+				}
+				continue
+			}
+			if err == io.EOF && s.shutdown {
+				return nil
+			}
+			return err
+		}
+		result, err := s.handle(m)
+		if err == errExit {
+			if !s.shutdown {
+				return errors.New("exit without shutdown")
+			}
+			return nil
+		}
+		if m.ID == nil {
+			// notifications get no response
+			continue
+		}
+		var rerr *responseError
+		if err != nil {
+			var ok bool
+			if rerr, ok = err.(*responseError); !ok {
+				rerr = &responseError{Code: codeInternalError, Message: err.Error()}
+			}
+		}
+		if err := s.reply(m.ID, result, rerr); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Server) reply(id *json.RawMessage, result interface{}, rerr *responseError) error {
+	if rerr != nil {
+		return writeMessage(s.out, &errorResponse{JSONRPC: "2.0", ID: id, Error: rerr})
+	}
+	return writeMessage(s.out, &response{JSONRPC: "2.0", ID: id, Result: result})
+}
+
+func (s *Server) notify(method string, params interface{}) error {
+	b, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return writeMessage(s.out, &message{JSONRPC: "2.0", Method: method, Params: b})
+}
+
+// handle dispatches m to its handler. A panic in the handler becomes an
+// internal error, so that one document the formatter chokes on does not
+// take the server down.
+func (s *Server) handle(m *message) (result interface{}, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			result, err = nil, &responseError{Code: codeInternalError, Message: fmt.Sprintf("%s: %v", m.Method, e)}
+		}
+	}()
+	return s.dispatch(m)
+}
+
+func (s *Server) dispatch(m *message) (interface{}, error) {
+	switch m.Method {
+	case "initialize":
+		return s.initialize()
+	case "initialized", "$/cancelRequest", "$/setTrace":
+		return nil, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+	case "exit":
+		return nil, errExit
+	case "textDocument/didOpen":
+		var p DidOpenTextDocumentParams
+		if err := unmarshal(m.Params, &p); err != nil {
+			return nil, err
+		}
+		return nil, s.update(p.TextDocument.URI, p.TextDocument.Text)
+	case "textDocument/didChange":
+		var p DidChangeTextDocumentParams
+		if err := unmarshal(m.Params, &p); err != nil {
+			return nil, err
+		}
+		if n := len(p.ContentChanges); n > 0 {
+			return nil, s.update(p.TextDocument.URI, p.ContentChanges[n-1].Text)
+		}
+		return nil, nil
+	case "textDocument/didClose":
+		var p DidCloseTextDocumentParams
+		if err := unmarshal(m.Params, &p); err != nil {
+			return nil, err
+		}
+		delete(s.docs, p.TextDocument.URI)
+		return nil, s.notify("textDocument/publishDiagnostics", PublishDiagnosticsParams{URI: p.TextDocument.URI, Diagnostics: []Diagnostic{}})
+	case "textDocument/formatting":
+		var p DocumentFormattingParams
+		if err := unmarshal(m.Params, &p); err != nil {
+			return nil, err
+		}
+		return s.format(p.TextDocument.URI, p.Options, nil)
+	case "textDocument/rangeFormatting":
+		var p DocumentRangeFormattingParams
+		if err := unmarshal(m.Params, &p); err != nil {
+			return nil, err
+		}
+		return s.format(p.TextDocument.URI, p.Options, &p.Range)
+	case "textDocument/onTypeFormatting":
+		var p DocumentOnTypeFormattingParams
+		if err := unmarshal(m.Params, &p); err != nil {
+			return nil, err
+		}
+		line := Range{Start: Position{Line: p.Position.Line}, End: Position{Line: p.Position.Line}}
+		return s.format(p.TextDocument.URI, p.Options, &line)
+	}
+	if m.ID == nil {
+		return nil, nil
+	}
+	return nil, &responseError{Code: codeMethodNotFound, Message: "method not supported: " + m.Method}
+}
+
+func unmarshal(params json.RawMessage, v interface{}) error {
+	if err := json.Unmarshal(params, v); err != nil {
+		return &responseError{Code: codeInvalidParams, Message: err.Error()}
+	}
+	return nil
+}
+
+func (s *Server) initialize() (interface{}, error) {
+	return InitializeResult{
+		Capabilities: ServerCapabilities{
+			TextDocumentSync:                TextDocumentSyncFull,
+			DocumentFormattingProvider:      true,
+			DocumentRangeFormattingProvider: true,
+			DocumentOnTypeFormattingProvider: &DocumentOnTypeFormattingOptions{
+				FirstTriggerCharacter: "}",
+				MoreTriggerCharacter:  []string{";"},
+			},
+		},
+		ServerInfo: ServerInfo{Name: "wsfmt"},
+	}, nil
+}
+
+// update stores the new text of a document and publishes its syntax
+// errors.
+func (s *Server) update(uri, text string) error {
+	s.docs[uri] = text
+	diags := []Diagnostic{}
+	opts, ok, err := s.options(uri, FormattingOptions{})
+	if err != nil {
+		return err
+	}
+	if ok {
+		if err := check(text, opts); err != nil {
+			d := diagnostic(text, err)
+			diags = append(diags, d)
+			// the lexical errors after the first error
+			start := d.Range.Start
+			errs, _ := format.LexErrors([]byte(text), opts)
+			for _, e := range errs {
+				if p := position(text, e.Pos); p.Line > start.Line || p.Line == start.Line && p.Character > start.Character {
+					diags = append(diags, diagnostic(text, e))
+				}
+			}
+		}
+	}
+	return s.notify("textDocument/publishDiagnostics", PublishDiagnosticsParams{URI: uri, Diagnostics: diags})
+}
+
+// check formats text and returns the error, if any. A panic in the
+// formatter is returned as an error so that it is published like any
+// other.
+func check(text string, opts format.Options) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("internal error: %v", e)
+		}
+	}()
+	_, err = format.Source([]byte(text), opts)
+	return err
+}
+
+// options returns the formatting options for the document at uri. ok is
+// false if a configuration file excludes the document.
+func (s *Server) options(uri string, fo FormattingOptions) (opts format.Options, ok bool, err error) {
+	name := uriPath(uri)
+	opts.Filename = name
+	if fo.InsertSpaces && fo.TabSize > 0 {
+		opts.Indent = format.Indent{Spaces: fo.TabSize}
+	}
+	st, err := s.configs.Resolve(name, opts)
+	if err != nil {
+		return opts, false, err
+	}
+	return st.Options, st.Excluded == nil, nil
+}
+
+// uriPath returns the file path of a file URI, or the URI itself if it is
+// not one.
+func uriPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return uri
+	}
+	p := u.Path
+	if len(p) > 2 && p[0] == '/' && p[2] == ':' {
+		p = p[1:] // /C:/dir on Windows
+	}
+	return filepath.FromSlash(p)
+}
+
+// format returns the edits that format the document at uri. If lines is
+// not nil only the statements overlapping those lines are formatted.
+func (s *Server) format(uri string, fo FormattingOptions, lines *Range) ([]TextEdit, error) {
+	text, ok := s.docs[uri]
+	if !ok {
+		return nil, &responseError{Code: codeInvalidParams, Message: "document not open: " + uri}
+	}
+	opts, ok, err := s.options(uri, fo)
+	if err != nil || !ok {
+		return []TextEdit{}, err
+	}
+	var out []byte
+	if lines != nil {
+		first, last := lines.Start.Line+1, lines.End.Line+1
+		if lines.End.Character == 0 && lines.End.Line > lines.Start.Line {
+			// the range ends at the start of a line, which it does not include
+			last--
+		}
+		out, err = format.Range([]byte(text), first, last, opts)
+	} else {
+		out, err = format.Source([]byte(text), opts)
+	}
+	if err != nil {
+		// the error is already published as a diagnostic
+		return []TextEdit{}, nil
+	}
+	return lineEdits(text, string(out)), nil
+}
+
+// lineEdits returns edits replacing whole lines that turn old into new.
+func lineEdits(old, new string) []TextEdit {
+	var (
+		a     = diff.Lines(old)
+		b     = diff.Lines(new)
+		eol   = "\n"
+		edits = []TextEdit{}
+	)
+	if format.DetectLineEnding(old) == format.CRLF {
+		eol = "\r\n"
+	}
+	script := diff.Diff(len(a), len(b), func(i, j int) bool { return a[i] == b[j] })
+	for i := 0; i < len(script); {
+		if script[i].Op == diff.Equal {
+			i++
+			continue
+		}
+		start, end := script[i].A, script[i].A
+		var text strings.Builder
+		for ; i < len(script) && script[i].Op != diff.Equal; i++ {
+			switch e := script[i]; e.Op {
+			case diff.Delete:
+				end = e.A + 1
+			case diff.Insert:
+				text.WriteString(b[e.B] + eol)
+			}
+		}
+		edits = append(edits, TextEdit{
+			Range:   Range{Start: Position{Line: start}, End: Position{Line: end}},
+			NewText: text.String(),
+		})
+	}
+	return edits
+}
+
+// diagnostic converts a formatting error into a diagnostic.
+func diagnostic(text string, err error) Diagnostic {
+	var (
+		pos lex.Position
+		val string
+		msg = err.Error()
+	)
+	switch e := err.(type) {
+	case *format.FormatError:
+		pos, val = e.Pos, e.Val
+		msg = strings.TrimPrefix(msg, e.Pos.String()+": ")
+	case *parser.Error:
+		pos = e.Pos
+		msg = e.Msg
+	case *lex.Error:
+		pos, val = e.Pos, e.Text
+		msg = e.Msg
+	case *format.VerifyError:
+		pos = e.Pos
+		msg = e.Msg
+	}
+	start := position(text, pos)
+	end := start
+	if line := lineText(text, start.Line); val != "" && !strings.Contains(val, "\n") {
+		end.Character += len(utf16.Encode([]rune(val)))
+		if n := len(utf16.Encode([]rune(line))); end.Character > n {
+			end.Character = n
+		}
+	}
+	return Diagnostic{
+		Range:    Range{Start: start, End: end},
+		Severity: SeverityError,
+		Source:   "wsfmt",
+		Message:  msg,
+	}
+}
+
+// position converts a lexer position to an LSP position.
+func position(text string, p lex.Position) Position {
+	if p.Line < 1 {
+		return Position{}
+	}
+	line := []rune(lineText(text, p.Line-1))
+	col := p.Column - 1
+	if col > len(line) {
+		col = len(line)
+	}
+	if col < 0 {
+		col = 0
+	}
+	return Position{Line: p.Line - 1, Character: len(utf16.Encode(line[:col]))}
+}
+
+// lineText returns line n, counting from 0, of text.
+func lineText(text string, n int) string {
+	lines := diff.Lines(text)
+	if n < len(lines) {
+		return lines[n]
+	}
+	return ""
+}
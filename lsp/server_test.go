@@ -0,0 +1,282 @@
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// client drives a Server over a pair of pipes.
+type client struct {
+	t    *testing.T
+	w    io.WriteCloser
+	r    *bufio.Reader
+	id   int
+	done chan error // result of Run
+}
+
+// reply is a response or notification as the client reads it.
+type reply struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  *responseError  `json:"error"`
+}
+
+func newClient(t *testing.T) *client {
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	c := &client{t: t, w: inW, r: bufio.NewReader(outR), done: make(chan error, 1)}
+	go func() {
+		c.done <- NewServer(inR, outW).Run()
+		outW.Close()
+	}()
+	return c
+}
+
+// write sends a message with the given body.
+func (c *client) write(body []byte) {
+	c.t.Helper()
+	if _, err := fmt.Fprintf(c.w, "Content-Length: %d\r\n\r\n%s", len(body), body); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// send sends a request, or a notification if id is nil.
+func (c *client) send(id interface{}, method string, params interface{}) {
+	c.t.Helper()
+	m := map[string]interface{}{"jsonrpc": "2.0", "method": method}
+	if id != nil {
+		m["id"] = id
+	}
+	if params != nil {
+		m["params"] = params
+	}
+	body, err := json.Marshal(m)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.write(body)
+}
+
+// readRaw returns the body of the next message from the server.
+func (c *client) readRaw() []byte {
+	c.t.Helper()
+	header, err := textproto.NewReader(c.r).ReadMIMEHeader()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	n, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		c.t.Fatal(err)
+	}
+	return body
+}
+
+func (c *client) read() *reply {
+	c.t.Helper()
+	var r reply
+	if err := json.Unmarshal(c.readRaw(), &r); err != nil {
+		c.t.Fatal(err)
+	}
+	return &r
+}
+
+// call sends a request and decodes the result of its response into
+// result.
+func (c *client) call(method string, params, result interface{}) {
+	c.t.Helper()
+	c.id++
+	c.send(c.id, method, params)
+	r := c.read()
+	if string(r.ID) != strconv.Itoa(c.id) {
+		c.t.Fatalf("%s: response id %s, want %d", method, r.ID, c.id)
+	}
+	if r.Error != nil {
+		c.t.Fatalf("%s: %v", method, r.Error)
+	}
+	if err := json.Unmarshal(r.Result, result); err != nil {
+		c.t.Fatalf("%s: result %s: %v", method, r.Result, err)
+	}
+}
+
+// diagnostics reads the diagnostics the server publishes for uri.
+func (c *client) diagnostics(uri string) []Diagnostic {
+	c.t.Helper()
+	r := c.read()
+	if r.Method != "textDocument/publishDiagnostics" {
+		c.t.Fatalf("got %s, want diagnostics", r.Method)
+	}
+	var p PublishDiagnosticsParams
+	if err := json.Unmarshal(r.Params, &p); err != nil {
+		c.t.Fatal(err)
+	}
+	if p.URI != uri {
+		c.t.Fatalf("diagnostics for %s, want %s", p.URI, uri)
+	}
+	return p.Diagnostics
+}
+
+func TestServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wsfmt-lsp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// keep configuration files outside the test from applying
+	if err := ioutil.WriteFile(filepath.Join(dir, ".wsfmt.toml"), []byte("root = true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	uri := "file://" + filepath.ToSlash(filepath.Join(dir, "test.ws"))
+	doc := TextDocumentIdentifier{URI: uri}
+	c := newClient(t)
+
+	var init InitializeResult
+	c.call("initialize", map[string]interface{}{}, &init)
+	if !init.Capabilities.DocumentFormattingProvider || !init.Capabilities.DocumentRangeFormattingProvider ||
+		init.Capabilities.DocumentOnTypeFormattingProvider == nil {
+		t.Errorf("capabilities = %+v", init.Capabilities)
+	}
+	c.send(nil, "initialized", map[string]interface{}{})
+
+	bad := "function F() {\n\tx = \"unclosed;\n}\n"
+	c.send(nil, "textDocument/didOpen", DidOpenTextDocumentParams{
+		TextDocument: TextDocumentItem{URI: uri, LanguageID: "witcherscript", Version: 1, Text: bad},
+	})
+	diags := c.diagnostics(uri)
+	if len(diags) == 0 || diags[0].Range.Start.Line != 1 || diags[0].Severity != SeverityError {
+		t.Errorf("diagnostics for %q = %+v, want an error on line 1", bad, diags)
+	}
+
+	text := "function F() {\nx=1;\n\ty = 2;\n}\n"
+	c.send(nil, "textDocument/didChange", DidChangeTextDocumentParams{
+		TextDocument:   doc,
+		ContentChanges: []TextDocumentContentChangeEvent{{Text: text}},
+	})
+	if diags := c.diagnostics(uri); len(diags) != 0 {
+		t.Errorf("diagnostics for %q = %+v, want none", text, diags)
+	}
+
+	want := []TextEdit{{
+		Range:   Range{Start: Position{Line: 1}, End: Position{Line: 2}},
+		NewText: "\tx = 1;\n",
+	}}
+	var edits []TextEdit
+	c.call("textDocument/formatting", DocumentFormattingParams{TextDocument: doc}, &edits)
+	if !reflect.DeepEqual(edits, want) {
+		t.Errorf("formatting edits = %+v, want %+v", edits, want)
+	}
+
+	c.call("textDocument/rangeFormatting", DocumentRangeFormattingParams{
+		TextDocument: doc,
+		Range:        Range{Start: Position{Line: 2}, End: Position{Line: 2, Character: 3}},
+	}, &edits)
+	if len(edits) != 0 {
+		t.Errorf("range formatting of a formatted line = %+v, want no edits", edits)
+	}
+	c.call("textDocument/rangeFormatting", DocumentRangeFormattingParams{
+		TextDocument: doc,
+		Range:        Range{Start: Position{Line: 1}, End: Position{Line: 2}},
+	}, &edits)
+	if !reflect.DeepEqual(edits, want) {
+		t.Errorf("range formatting edits = %+v, want %+v", edits, want)
+	}
+
+	c.call("textDocument/onTypeFormatting", DocumentOnTypeFormattingParams{
+		TextDocument: doc,
+		Position:     Position{Line: 1, Character: 4},
+		Ch:           ";",
+	}, &edits)
+	if !reflect.DeepEqual(edits, want) {
+		t.Errorf("on type formatting edits = %+v, want %+v", edits, want)
+	}
+
+	c.id++
+	c.send(c.id, "textDocument/hover", map[string]interface{}{})
+	if r := c.read(); string(r.ID) != strconv.Itoa(c.id) || r.Error == nil || r.Error.Code != codeMethodNotFound {
+		t.Errorf("unknown method: got id %s, error %+v", r.ID, r.Error)
+	}
+
+	var result interface{}
+	c.call("shutdown", nil, &result)
+	if result != nil {
+		t.Errorf("shutdown result = %v, want null", result)
+	}
+	c.send(nil, "exit", nil)
+	if err := <-c.done; err != nil {
+		t.Errorf("Run after exit = %v", err)
+	}
+}
+
+// TestParseError checks that a message that is not JSON gets an error
+// response with a null id, as JSON-RPC requires.
+func TestParseError(t *testing.T) {
+	c := newClient(t)
+	c.write([]byte("{not json"))
+	var r map[string]json.RawMessage
+	if err := json.Unmarshal(c.readRaw(), &r); err != nil {
+		t.Fatal(err)
+	}
+	if id, ok := r["id"]; !ok || string(id) != "null" {
+		t.Errorf("id = %s (present %t), want null", id, ok)
+	}
+	var e responseError
+	if err := json.Unmarshal(r["error"], &e); err != nil || e.Code != codeParseError {
+		t.Errorf("error = %s, want code %d", r["error"], codeParseError)
+	}
+	if _, ok := r["result"]; ok {
+		t.Errorf("error response has a result")
+	}
+	c.w.Close()
+	<-c.done
+}
+
+// TestUnbalanced checks that a document the formatter cannot make sense
+// of gets a diagnostic and leaves the server answering requests.
+func TestUnbalanced(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wsfmt-lsp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, ".wsfmt.toml"), []byte("root = true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	uri := "file://" + filepath.ToSlash(filepath.Join(dir, "test.ws"))
+	c := newClient(t)
+
+	text := "function F() {\n}\n}\n"
+	c.send(nil, "textDocument/didOpen", DidOpenTextDocumentParams{
+		TextDocument: TextDocumentItem{URI: uri, LanguageID: "witcherscript", Version: 1, Text: text},
+	})
+	diags := c.diagnostics(uri)
+	if len(diags) == 0 || diags[0].Range.Start.Line != 2 {
+		t.Errorf("diagnostics for %q = %+v, want an error on line 2", text, diags)
+	}
+
+	var edits []TextEdit
+	c.call("textDocument/formatting", DocumentFormattingParams{TextDocument: TextDocumentIdentifier{URI: uri}}, &edits)
+	if len(edits) != 0 {
+		t.Errorf("formatting edits = %+v, want none", edits)
+	}
+
+	var result interface{}
+	c.call("shutdown", nil, &result)
+	c.send(nil, "exit", nil)
+	if err := <-c.done; err != nil {
+		t.Errorf("Run after exit = %v", err)
+	}
+}
@@ -0,0 +1,693 @@
+// Package parser implements a recursive-descent parser for WitcherScript
+// source files. It reads tokens from the text/lex scanner and produces a
+// syntax tree of the ast package.
+package parser
+
+import (
+	"fmt"
+
+	"timmy.narnian.us/git/timmy/wsfmt/ast"
+	"timmy.narnian.us/git/timmy/wsfmt/text/lex"
+)
+
+// Error is a syntax error in the parsed source.
+type Error struct {
+	Pos lex.Position // position of the offending token
+	Msg string       // description of the problem
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Pos, e.Msg)
+}
+
+// ParseFile parses the source of a single file. Every comment in the
+// source is recorded in the Comments of the returned file. Parsing stops
+// at the first syntax error, which is returned as an *Error.
+func ParseFile(name, src string) (f *ast.File, err error) {
+	p := &parser{
+		l: lex.Lex(name, src),
+		file: &ast.File{
+			Name: name,
+		},
+	}
+	p.file.Lines = p.l.File()
+	defer func() {
+		p.l.Close()
+		if e := recover(); e != nil {
+			perr, ok := e.(*Error)
+			if !ok {
+				panic(e)
+			}
+			f, err = nil, perr
+		}
+	}()
+	p.parseFile()
+	return p.file, nil
+}
+
+// parser holds the state of a single parse.
+type parser struct {
+	l     *lex.Lexer
+	file  *ast.File
+	tok   lex.Item   // current token
+	ahead []lex.Item // significant tokens read past tok
+}
+
+// next advances to the next significant token.
+func (p *parser) next() {
+	p.fill(1)
+	p.tok = p.ahead[0]
+	p.ahead = p.ahead[1:]
+	if p.tok.Typ == lex.ItemError {
+		p.errorf("%s", p.tok.Val)
+	}
+}
+
+// peek returns the token after the current one without consuming it.
+func (p *parser) peek() lex.Item {
+	p.fill(1)
+	return p.ahead[0]
+}
+
+// fill reads from the lexer until at least n significant tokens are
+// buffered. Whitespace is dropped and comments are recorded in the file.
+func (p *parser) fill(n int) {
+	for len(p.ahead) < n {
+		item := p.l.NextItem()
+		switch item.Typ {
+		case lex.ItemSpace, lex.ItemNewline:
+		case lex.ItemComment:
+			p.file.Comments = append(p.file.Comments, &ast.Comment{Slash: item.Pos, Text: item.Val})
+		default:
+			p.ahead = append(p.ahead, item)
+		}
+	}
+}
+
+// errorf stops parsing with an error at the current token.
+func (p *parser) errorf(format string, args ...interface{}) {
+	panic(&Error{
+		Pos: p.l.Position(p.tok),
+		Msg: fmt.Sprintf(format, args...),
+	})
+}
+
+// found describes the current token for error messages.
+func (p *parser) found() string {
+	if p.tok.Typ == lex.ItemEOF {
+		return "EOF"
+	}
+	if name, ok := lex.Rkey[p.tok.Typ]; ok {
+		return fmt.Sprintf("%s %q", name, p.tok.Val)
+	}
+	return fmt.Sprintf("%q", p.tok.Val)
+}
+
+// expect consumes the current token if its value is val and reports an
+// error otherwise. It returns the position of the consumed token.
+func (p *parser) expect(val string) lex.Pos {
+	if p.tok.Val != val {
+		p.errorf("expected %q, found %s", val, p.found())
+	}
+	pos := p.tok.Pos
+	p.next()
+	return pos
+}
+
+// expectType consumes the current token if it has type t and reports an
+// error otherwise. It returns the consumed token.
+func (p *parser) expectType(t lex.ItemType) lex.Item {
+	if p.tok.Typ != t {
+		p.errorf("expected %s, found %s", lex.Rkey[t], p.found())
+	}
+	item := p.tok
+	p.next()
+	return item
+}
+
+func (p *parser) parseIdent() *ast.Ident {
+	item := p.expectType(lex.ItemIdentifier)
+	return &ast.Ident{NamePos: item.Pos, Name: item.Val}
+}
+
+// ----------------------------------------------------------------------------
+// Declarations
+
+func (p *parser) parseFile() {
+	p.next()
+	for p.tok.Typ != lex.ItemEOF {
+		p.file.Decls = append(p.file.Decls, p.parseDecl())
+	}
+	p.file.EOF = p.tok.Pos
+}
+
+// isModifier reports whether t may precede a declaration keyword.
+func isModifier(t lex.ItemType) bool {
+	switch t {
+	case lex.ItemModifiers, lex.ItemLatent, lex.ItemCleanup, lex.ItemReward, lex.ItemOptional:
+		return true
+	}
+	return false
+}
+
+func (p *parser) parseMods() []*ast.Ident {
+	var mods []*ast.Ident
+	for isModifier(p.tok.Typ) {
+		mods = append(mods, &ast.Ident{NamePos: p.tok.Pos, Name: p.tok.Val})
+		p.next()
+	}
+	return mods
+}
+
+func (p *parser) parseDecl() ast.Decl {
+	if p.tok.Val == ";" {
+		d := &ast.EmptyDecl{Semi: p.tok.Pos}
+		p.next()
+		return d
+	}
+	mods := p.parseMods()
+	switch p.tok.Typ {
+	case lex.ItemFunction, lex.ItemEvent:
+		return p.parseFuncDecl(mods)
+	case lex.ItemVar:
+		return p.parseVarDecl(mods)
+	case lex.ItemClass:
+		return p.parseClassDecl(mods)
+	case lex.ItemState:
+		return p.parseStateDecl(mods)
+	case lex.ItemStruct:
+		return p.parseStructDecl(mods)
+	case lex.ItemAutobind:
+		return p.parseAutobindDecl(mods)
+	}
+	if len(mods) > 0 {
+		p.errorf("expected declaration after modifier %q, found %s", mods[len(mods)-1].Name, p.found())
+	}
+	switch p.tok.Typ {
+	case lex.ItemEnum:
+		return p.parseEnumDecl()
+	case lex.ItemDefault:
+		return p.parseDefaultDecl()
+	case lex.ItemDefaults:
+		return p.parseDefaultsDecl()
+	case lex.ItemHint:
+		return p.parseHintDecl()
+	}
+	p.errorf("expected declaration, found %s", p.found())
+	return nil
+}
+
+func (p *parser) parseFuncDecl(mods []*ast.Ident) *ast.FuncDecl {
+	d := &ast.FuncDecl{
+		Mods: mods,
+		Func: p.tok.Pos,
+		Kind: p.tok.Typ,
+		Semi: ast.NoPos,
+	}
+	p.next()
+	d.Name = p.parseIdent()
+	p.expect("(")
+	for p.tok.Val != ")" {
+		d.Params = append(d.Params, p.parseField())
+		if p.tok.Val != "," {
+			break
+		}
+		p.next()
+	}
+	d.Rparen = p.expect(")")
+	if p.tok.Val == ":" {
+		p.next()
+		d.Result = p.parseType()
+	}
+	if p.tok.Val == "{" {
+		d.Body = p.parseBlock()
+	} else {
+		d.Semi = p.expect(";")
+	}
+	return d
+}
+
+// parseField parses a parameter group: [modifiers] a, b : Type
+func (p *parser) parseField() *ast.Field {
+	f := &ast.Field{Mods: p.parseMods()}
+	f.Names = p.parseIdentList()
+	p.expect(":")
+	f.Type = p.parseType()
+	return f
+}
+
+func (p *parser) parseIdentList() []*ast.Ident {
+	list := []*ast.Ident{p.parseIdent()}
+	for p.tok.Val == "," {
+		p.next()
+		list = append(list, p.parseIdent())
+	}
+	return list
+}
+
+func (p *parser) parseVarDecl(mods []*ast.Ident) *ast.VarDecl {
+	d := &ast.VarDecl{Mods: mods, Var: p.tok.Pos}
+	p.next()
+	d.Names = p.parseIdentList()
+	p.expect(":")
+	d.Type = p.parseType()
+	if p.tok.Val == "=" {
+		p.next()
+		d.Value = p.parseExpr()
+	}
+	d.Semi = p.expect(";")
+	return d
+}
+
+func (p *parser) parseClassDecl(mods []*ast.Ident) *ast.ClassDecl {
+	d := &ast.ClassDecl{Mods: mods, Class: p.tok.Pos}
+	p.next()
+	d.Name = p.parseIdent()
+	d.Extends = p.parseExtends()
+	d.Lbrace, d.Members, d.Rbrace = p.parseMembers()
+	return d
+}
+
+func (p *parser) parseStateDecl(mods []*ast.Ident) *ast.StateDecl {
+	d := &ast.StateDecl{Mods: mods, State: p.tok.Pos}
+	p.next()
+	d.Name = p.parseIdent()
+	p.expectType(lex.ItemIn)
+	d.In = p.parseIdent()
+	d.Extends = p.parseExtends()
+	d.Lbrace, d.Members, d.Rbrace = p.parseMembers()
+	return d
+}
+
+func (p *parser) parseExtends() *ast.Ident {
+	if p.tok.Typ != lex.ItemExtends {
+		return nil
+	}
+	p.next()
+	return p.parseIdent()
+}
+
+func (p *parser) parseStructDecl(mods []*ast.Ident) *ast.StructDecl {
+	d := &ast.StructDecl{Mods: mods, Struct: p.tok.Pos}
+	p.next()
+	d.Name = p.parseIdent()
+	d.Lbrace, d.Members, d.Rbrace = p.parseMembers()
+	return d
+}
+
+// parseMembers parses the braced member list of a class, state or struct.
+func (p *parser) parseMembers() (lbrace lex.Pos, members []ast.Decl, rbrace lex.Pos) {
+	lbrace = p.expect("{")
+	for p.tok.Val != "}" && p.tok.Typ != lex.ItemEOF {
+		members = append(members, p.parseDecl())
+	}
+	rbrace = p.expect("}")
+	return lbrace, members, rbrace
+}
+
+func (p *parser) parseEnumDecl() *ast.EnumDecl {
+	d := &ast.EnumDecl{Enum: p.tok.Pos}
+	p.next()
+	d.Name = p.parseIdent()
+	d.Lbrace = p.expect("{")
+	for p.tok.Val != "}" {
+		v := &ast.EnumValue{Name: p.parseIdent(), Comma: ast.NoPos}
+		if p.tok.Val == "=" {
+			p.next()
+			v.Value = p.parseExpr()
+		}
+		d.Values = append(d.Values, v)
+		if p.tok.Val != "," {
+			break
+		}
+		v.Comma = p.tok.Pos
+		p.next()
+	}
+	d.Rbrace = p.expect("}")
+	return d
+}
+
+func (p *parser) parseDefaultDecl() *ast.DefaultDecl {
+	d := &ast.DefaultDecl{Default: p.tok.Pos}
+	p.next()
+	d.Name = p.parseExpr()
+	p.expect("=")
+	d.Value = p.parseExpr()
+	d.Semi = p.expect(";")
+	return d
+}
+
+func (p *parser) parseDefaultsDecl() *ast.DefaultsDecl {
+	d := &ast.DefaultsDecl{Defaults: p.tok.Pos}
+	p.next()
+	d.Body = p.parseBlock()
+	return d
+}
+
+func (p *parser) parseHintDecl() *ast.HintDecl {
+	d := &ast.HintDecl{Hint: p.tok.Pos}
+	p.next()
+	d.Name = p.parseIdent()
+	p.expect("=")
+	d.Value = p.parseExpr()
+	d.Semi = p.expect(";")
+	return d
+}
+
+func (p *parser) parseAutobindDecl(mods []*ast.Ident) *ast.AutobindDecl {
+	d := &ast.AutobindDecl{Mods: mods, Autobind: p.tok.Pos}
+	p.next()
+	d.Name = p.parseIdent()
+	p.expect(":")
+	d.Type = p.parseType()
+	p.expect("=")
+	if p.tok.Typ == lex.ItemSingle {
+		d.Value = &ast.Ident{NamePos: p.tok.Pos, Name: p.tok.Val}
+		p.next()
+	} else {
+		d.Value = p.parseExpr()
+	}
+	d.Semi = p.expect(";")
+	return d
+}
+
+// parseType parses a type name or array<Type>.
+func (p *parser) parseType() ast.Expr {
+	if p.tok.Typ != lex.ItemArray {
+		return p.parseIdent()
+	}
+	t := &ast.ArrayType{Array: p.tok.Pos}
+	p.next()
+	p.expect("<")
+	t.Elem = p.parseType()
+	t.Gt = p.expect(">")
+	return t
+}
+
+// ----------------------------------------------------------------------------
+// Statements
+
+func (p *parser) parseBlock() *ast.BlockStmt {
+	b := &ast.BlockStmt{Lbrace: p.expect("{")}
+	for p.tok.Val != "}" && p.tok.Typ != lex.ItemEOF {
+		b.List = append(b.List, p.parseStmt())
+	}
+	b.Rbrace = p.expect("}")
+	return b
+}
+
+func (p *parser) parseStmt() ast.Stmt {
+	switch p.tok.Typ {
+	case lex.ItemLeftBrace:
+		return p.parseBlock()
+	case lex.ItemVar:
+		return &ast.DeclStmt{Decl: p.parseVarDecl(nil)}
+	case lex.ItemIf:
+		return p.parseIfStmt()
+	case lex.ItemWhile:
+		s := &ast.WhileStmt{While: p.tok.Pos}
+		p.next()
+		s.Cond = p.parseParenCond()
+		s.Body = p.parseStmt()
+		return s
+	case lex.ItemFor:
+		return p.parseForStmt()
+	case lex.ItemSwitch:
+		return p.parseSwitchStmt()
+	case lex.ItemReturn:
+		s := &ast.ReturnStmt{Return: p.tok.Pos}
+		p.next()
+		if p.tok.Val != ";" {
+			s.Result = p.parseExpr()
+		}
+		s.Semi = p.expect(";")
+		return s
+	case lex.ItemBreak, lex.ItemContinue:
+		s := &ast.BranchStmt{TokPos: p.tok.Pos, Tok: p.tok.Typ}
+		p.next()
+		s.Semi = p.expect(";")
+		return s
+	case lex.ItemDelete:
+		s := &ast.DeleteStmt{Delete: p.tok.Pos}
+		p.next()
+		s.X = p.parseExpr()
+		s.Semi = p.expect(";")
+		return s
+	case lex.ItemIdentifier:
+		if p.tok.Val == "do" {
+			return p.parseDoWhileStmt()
+		}
+	}
+	if p.tok.Val == ";" {
+		s := &ast.EmptyStmt{Semi: p.tok.Pos}
+		p.next()
+		return s
+	}
+	s := p.parseSimpleStmt()
+	semi := p.expect(";")
+	switch s := s.(type) {
+	case *ast.ExprStmt:
+		s.Semi = semi
+	case *ast.AssignStmt:
+		s.Semi = semi
+	}
+	return s
+}
+
+// isAssignOp reports whether t is an assignment operator.
+func isAssignOp(t lex.ItemType) bool {
+	switch t {
+	case lex.ItemAssign, lex.ItemAddAssign, lex.ItemSubAssign, lex.ItemMulAssign,
+		lex.ItemDivAssign, lex.ItemModAssign, lex.ItemAndAssign, lex.ItemOrAssign:
+		return true
+	}
+	return false
+}
+
+// parseSimpleStmt parses an expression or assignment without the
+// terminating semicolon.
+func (p *parser) parseSimpleStmt() ast.Stmt {
+	x := p.parseExpr()
+	if isAssignOp(p.tok.Typ) {
+		s := &ast.AssignStmt{Lhs: x, TokPos: p.tok.Pos, Tok: p.tok.Val, Semi: ast.NoPos}
+		p.next()
+		s.Rhs = p.parseExpr()
+		return s
+	}
+	return &ast.ExprStmt{X: x, Semi: ast.NoPos}
+}
+
+// parseParenCond parses a parenthesized condition. The parentheses belong
+// to the statement and are not kept in the tree.
+func (p *parser) parseParenCond() ast.Expr {
+	p.expect("(")
+	x := p.parseExpr()
+	p.expect(")")
+	return x
+}
+
+func (p *parser) parseIfStmt() *ast.IfStmt {
+	s := &ast.IfStmt{If: p.tok.Pos, ElsePos: ast.NoPos}
+	p.next()
+	s.Cond = p.parseParenCond()
+	s.Body = p.parseStmt()
+	if p.tok.Typ == lex.ItemElse {
+		s.ElsePos = p.tok.Pos
+		p.next()
+		s.Else = p.parseStmt()
+	}
+	return s
+}
+
+func (p *parser) parseForStmt() *ast.ForStmt {
+	s := &ast.ForStmt{For: p.tok.Pos}
+	p.next()
+	p.expect("(")
+	if p.tok.Val != ";" {
+		s.Init = p.parseSimpleStmt()
+	}
+	p.expect(";")
+	if p.tok.Val != ";" {
+		s.Cond = p.parseExpr()
+	}
+	p.expect(";")
+	if p.tok.Val != ")" {
+		s.Post = p.parseSimpleStmt()
+	}
+	p.expect(")")
+	s.Body = p.parseStmt()
+	return s
+}
+
+func (p *parser) parseDoWhileStmt() *ast.DoWhileStmt {
+	s := &ast.DoWhileStmt{Do: p.tok.Pos}
+	p.next()
+	s.Body = p.parseStmt()
+	s.While = p.expectType(lex.ItemWhile).Pos
+	s.Cond = p.parseParenCond()
+	s.Semi = p.expect(";")
+	return s
+}
+
+func (p *parser) parseSwitchStmt() *ast.SwitchStmt {
+	s := &ast.SwitchStmt{Switch: p.tok.Pos}
+	p.next()
+	s.Tag = p.parseParenCond()
+	s.Lbrace = p.expect("{")
+	for p.tok.Val != "}" && p.tok.Typ != lex.ItemEOF {
+		c := &ast.CaseClause{Case: p.tok.Pos}
+		switch p.tok.Typ {
+		case lex.ItemCase:
+			p.next()
+			c.Value = p.parseExpr()
+		case lex.ItemDefault:
+			p.next()
+		default:
+			p.errorf("expected case or default, found %s", p.found())
+		}
+		c.Colon = p.expect(":")
+		for p.tok.Typ != lex.ItemCase && p.tok.Typ != lex.ItemDefault && p.tok.Val != "}" && p.tok.Typ != lex.ItemEOF {
+			c.Body = append(c.Body, p.parseStmt())
+		}
+		s.Body = append(s.Body, c)
+	}
+	s.Rbrace = p.expect("}")
+	return s
+}
+
+// ----------------------------------------------------------------------------
+// Expressions
+
+func (p *parser) parseExpr() ast.Expr {
+	x := p.parseBinaryExpr(1)
+	if p.tok.Val != "?" {
+		return x
+	}
+	p.next()
+	c := &ast.CondExpr{Cond: x, X: p.parseExpr()}
+	p.expect(":")
+	c.Y = p.parseExpr()
+	return c
+}
+
+func (p *parser) parseBinaryExpr(prec1 int) ast.Expr {
+	x := p.parseUnaryExpr()
+	for {
+		prec := p.tok.Typ.Precedence()
+		if prec < prec1 {
+			return x
+		}
+		op := p.tok
+		p.next()
+		x = &ast.BinaryExpr{X: x, OpPos: op.Pos, Op: op.Val, Y: p.parseBinaryExpr(prec + 1)}
+	}
+}
+
+func (p *parser) parseUnaryExpr() ast.Expr {
+	switch p.tok.Typ {
+	case lex.ItemNot, lex.ItemSub, lex.ItemAdd, lex.ItemTilde:
+		x := &ast.UnaryExpr{OpPos: p.tok.Pos, Op: p.tok.Val}
+		p.next()
+		x.X = p.parseUnaryExpr()
+		return x
+	case lex.ItemIncrement, lex.ItemDecrement:
+		x := &ast.IncDecExpr{TokPos: p.tok.Pos, Tok: p.tok.Val}
+		p.next()
+		x.X = p.parseUnaryExpr()
+		return x
+	}
+	return p.parsePostfixExpr(p.parseOperand())
+}
+
+// startsOperand reports whether the current token can begin an operand
+// that is not a unary expression. It decides whether a parenthesized name
+// is a cast.
+func (p *parser) startsOperand() bool {
+	switch p.tok.Typ {
+	case lex.ItemIdentifier, lex.ItemNumber, lex.ItemString, lex.ItemName, lex.ItemBool, lex.ItemNULL,
+		lex.ItemThis, lex.ItemSuper, lex.ItemParent, lex.ItemVirtualParent, lex.ItemNew,
+		lex.ItemLeftParen:
+		return true
+	}
+	return false
+}
+
+func (p *parser) parseOperand() ast.Expr {
+	switch p.tok.Typ {
+	case lex.ItemIdentifier, lex.ItemThis, lex.ItemSuper, lex.ItemParent, lex.ItemVirtualParent:
+		x := &ast.Ident{NamePos: p.tok.Pos, Name: p.tok.Val}
+		p.next()
+		return x
+	case lex.ItemNumber, lex.ItemString, lex.ItemName, lex.ItemBool, lex.ItemNULL:
+		x := &ast.BasicLit{ValuePos: p.tok.Pos, Kind: p.tok.Typ, Value: p.tok.Val}
+		p.next()
+		return x
+	case lex.ItemLeftParen:
+		lparen := p.tok.Pos
+		p.next()
+		x := p.parseExpr()
+		rparen := p.expect(")")
+		if id, ok := x.(*ast.Ident); ok && p.startsOperand() {
+			return &ast.CastExpr{Lparen: lparen, Type: id, X: p.parseUnaryExpr()}
+		}
+		return &ast.ParenExpr{Lparen: lparen, X: x, Rparen: rparen}
+	case lex.ItemNew:
+		x := &ast.NewExpr{New: p.tok.Pos}
+		p.next()
+		x.Type = p.parseType()
+		if p.tok.Typ == lex.ItemIn {
+			p.next()
+			x.Owner = p.parsePostfixExpr(p.parseOperand())
+		}
+		return x
+	}
+	p.errorf("expected expression, found %s", p.found())
+	return nil
+}
+
+func (p *parser) parsePostfixExpr(x ast.Expr) ast.Expr {
+	for {
+		switch {
+		case p.tok.Typ == lex.ItemDot:
+			p.next()
+			x = &ast.SelectorExpr{X: x, Sel: p.parseIdent()}
+		case p.tok.Typ == lex.ItemLeftParen:
+			x = p.parseCallExpr(x)
+		case p.tok.Typ == lex.ItemLeftBracket:
+			ix := &ast.IndexExpr{X: x, Lbrack: p.tok.Pos}
+			p.next()
+			ix.Index = p.parseExpr()
+			ix.Rbrack = p.expect("]")
+			x = ix
+		case p.tok.Typ == lex.ItemIncrement || p.tok.Typ == lex.ItemDecrement:
+			x = &ast.IncDecExpr{X: x, TokPos: p.tok.Pos, Tok: p.tok.Val, Post: true}
+			p.next()
+		default:
+			return x
+		}
+	}
+}
+
+// parseCallExpr parses an argument list. Optional arguments may be skipped
+// by leaving them empty, as in F(a, , c); they are recorded as nil.
+func (p *parser) parseCallExpr(fun ast.Expr) *ast.CallExpr {
+	call := &ast.CallExpr{Fun: fun, Lparen: p.tok.Pos}
+	p.next()
+	for p.tok.Val != ")" {
+		if p.tok.Val == "," {
+			call.Args = append(call.Args, nil)
+		} else {
+			call.Args = append(call.Args, p.parseExpr())
+			if p.tok.Val != "," {
+				break
+			}
+		}
+		call.Commas = append(call.Commas, p.tok.Pos)
+		p.next()
+		if p.tok.Val == ")" {
+			call.Args = append(call.Args, nil)
+		}
+	}
+	call.Rparen = p.expect(")")
+	return call
+}
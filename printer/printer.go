@@ -0,0 +1,617 @@
+// Package printer implements printing of WitcherScript syntax trees in the
+// layout produced by wsfmt.
+package printer
+
+import (
+	"bytes"
+	"io"
+	"strings"
+
+	"timmy.narnian.us/git/timmy/wsfmt/ast"
+	"timmy.narnian.us/git/timmy/wsfmt/text/lex"
+)
+
+// Config controls the output of Fprint.
+type Config struct {
+	MaxNewlines int    // maximum number of consecutive newlines kept; 0 means 3
+	Indent      string // text of one level of indentation; "" means a tab
+
+	// BraceNextLine puts opening braces on a line of their own instead of
+	// at the end of the line that opens the block.
+	BraceNextLine bool
+}
+
+// Fprint prints the syntax tree of file to w. Comments are printed
+// between the tokens they appear between in the source.
+func (c *Config) Fprint(w io.Writer, file *ast.File) error {
+	p := &printer{
+		Config:   *c,
+		file:     file,
+		comments: file.Comments,
+		bol:      true,
+	}
+	if p.MaxNewlines <= 0 {
+		p.MaxNewlines = 3
+	}
+	if p.Indent == "" {
+		p.Indent = "\t"
+	}
+	p.printFile()
+	_, err := w.Write(p.out.Bytes())
+	return err
+}
+
+// printer holds the state of a single Fprint.
+type printer struct {
+	Config
+	file         *ast.File
+	out          bytes.Buffer
+	indent       int            // current indentation level
+	comments     []*ast.Comment // comments not printed yet
+	line         int            // source line of the last printed token or comment
+	bol          bool           // at the beginning of an output line
+	lineComment  bool           // a // comment was printed; the line must end
+	cont         bool           // the line continues after a // comment broke it
+	blockComment bool           // a /* */ comment was printed last
+	leading      bool           // the line holds only comments so far
+}
+
+// lineOf returns the source line of pos.
+func (p *printer) lineOf(pos lex.Pos) int {
+	return p.file.Lines.Position(pos).Line
+}
+
+// write writes s to the current line, indenting it first if the line is
+// empty. A // comment in the middle of a line breaks it, and the rest is
+// indented two more levels as a continuation. Text after a /* */ comment
+// is separated from it by a space unless it closes or ends something.
+func (p *printer) write(s string) {
+	if p.lineComment {
+		p.newline(0)
+		p.cont = true
+	}
+	switch {
+	case p.bol:
+		indent := p.indent
+		if p.cont {
+			indent += 2
+		}
+		p.out.WriteString(strings.Repeat(p.Indent, indent))
+		p.bol = false
+	case p.blockComment && !strings.ContainsAny(s[:1], " )],;"):
+		p.out.WriteString(" ")
+	}
+	p.blockComment = false
+	p.leading = false
+	p.out.WriteString(s)
+}
+
+// token prints s, the text of the token at pos, after any comments that
+// precede it in the source.
+func (p *printer) token(pos lex.Pos, s string) {
+	p.flush(pos)
+	p.write(s)
+	p.line = p.lineOf(pos)
+}
+
+// newline ends the current line and adds up to blank empty lines.
+func (p *printer) newline(blank int) {
+	if blank > p.MaxNewlines-1 {
+		blank = p.MaxNewlines - 1
+	}
+	p.out.WriteString("\n")
+	for ; blank > 0; blank-- {
+		p.out.WriteString("\n")
+	}
+	p.bol = true
+	p.lineComment = false
+	p.cont = false
+	p.blockComment = false
+}
+
+// linebreak starts a new line for the node at pos, keeping the blank lines
+// that precede it in the source. A node that follows /* */ comments on a
+// line of their own stays on that line.
+func (p *printer) linebreak(pos lex.Pos) {
+	p.flush(pos)
+	if p.leading && p.blockComment && p.lineOf(pos) == p.line {
+		return
+	}
+	if !p.bol {
+		p.newline(p.lineOf(pos) - p.line - 1)
+	}
+}
+
+// hasComments reports whether there are comments before pos that have not
+// been printed.
+func (p *printer) hasComments(pos lex.Pos) bool {
+	return len(p.comments) > 0 && p.comments[0].Pos() < pos
+}
+
+// flush prints the comments that appear in the source before pos. A
+// comment on the same source line as the last token stays on that line;
+// any other comment starts a line of its own.
+func (p *printer) flush(pos lex.Pos) {
+	for p.hasComments(pos) {
+		c := p.comments[0]
+		p.comments = p.comments[1:]
+		line := p.lineOf(c.Pos())
+		switch {
+		case p.bol:
+		case line == p.line && !p.lineComment:
+			if !bytes.HasSuffix(p.out.Bytes(), []byte(" ")) {
+				p.out.WriteString(" ")
+			}
+			p.blockComment = false
+		default:
+			p.newline(line - p.line - 1)
+		}
+		leading := p.bol || p.leading
+		p.write(c.Text)
+		p.line = p.lineOf(c.End() - 1)
+		p.lineComment = strings.HasPrefix(c.Text, "//")
+		p.blockComment = !p.lineComment
+		p.leading = leading
+	}
+}
+
+func (p *printer) printFile() {
+	p.declList(p.file.Decls)
+	p.flush(p.file.EOF + 1)
+	if !p.bol {
+		p.newline(0)
+	}
+}
+
+// ----------------------------------------------------------------------------
+// Declarations
+
+// declList prints declarations one per line. A stray semicolon stays on
+// the line of the declaration before it.
+func (p *printer) declList(list []ast.Decl) {
+	for i, d := range list {
+		if _, ok := d.(*ast.EmptyDecl); !ok || i == 0 {
+			p.linebreak(d.Pos())
+		}
+		p.decl(d)
+	}
+}
+
+// members prints the braced member list of a class, state or struct.
+func (p *printer) members(lbrace lex.Pos, list []ast.Decl, rbrace lex.Pos) {
+	p.lbrace(lbrace)
+	if len(list) > 0 || p.hasComments(rbrace) {
+		p.indent++
+		p.declList(list)
+		p.linebreak(rbrace)
+		p.indent--
+	}
+	p.token(rbrace, "}")
+}
+
+func (p *printer) mods(mods []*ast.Ident) {
+	for _, m := range mods {
+		p.ident(m)
+		p.write(" ")
+	}
+}
+
+func (p *printer) identList(list []*ast.Ident) {
+	for i, x := range list {
+		if i > 0 {
+			p.write(", ")
+		}
+		p.ident(x)
+	}
+}
+
+func (p *printer) decl(d ast.Decl) {
+	switch d := d.(type) {
+	case *ast.FuncDecl:
+		p.mods(d.Mods)
+		p.token(d.Func, lex.Rkey[d.Kind])
+		p.write(" ")
+		p.ident(d.Name)
+		p.write("(")
+		for i, f := range d.Params {
+			if i > 0 {
+				p.write(", ")
+			}
+			p.mods(f.Mods)
+			p.identList(f.Names)
+			p.write(": ")
+			p.expr(f.Type)
+		}
+		p.token(d.Rparen, ")")
+		if d.Result != nil {
+			p.write(": ")
+			p.expr(d.Result)
+		}
+		if d.Body != nil {
+			p.block(d.Body)
+		} else {
+			p.token(d.Semi, ";")
+		}
+	case *ast.VarDecl:
+		p.mods(d.Mods)
+		p.token(d.Var, "var")
+		p.write(" ")
+		p.identList(d.Names)
+		p.write(": ")
+		p.expr(d.Type)
+		if d.Value != nil {
+			p.write(" = ")
+			p.expr(d.Value)
+		}
+		p.token(d.Semi, ";")
+	case *ast.ClassDecl:
+		p.mods(d.Mods)
+		p.token(d.Class, "class")
+		p.write(" ")
+		p.ident(d.Name)
+		if d.Extends != nil {
+			p.write(" extends ")
+			p.ident(d.Extends)
+		}
+		p.members(d.Lbrace, d.Members, d.Rbrace)
+	case *ast.StateDecl:
+		p.mods(d.Mods)
+		p.token(d.State, "state")
+		p.write(" ")
+		p.ident(d.Name)
+		p.write(" in ")
+		p.ident(d.In)
+		if d.Extends != nil {
+			p.write(" extends ")
+			p.ident(d.Extends)
+		}
+		p.members(d.Lbrace, d.Members, d.Rbrace)
+	case *ast.StructDecl:
+		p.mods(d.Mods)
+		p.token(d.Struct, "struct")
+		p.write(" ")
+		p.ident(d.Name)
+		p.members(d.Lbrace, d.Members, d.Rbrace)
+	case *ast.EnumDecl:
+		p.token(d.Enum, "enum")
+		p.write(" ")
+		p.ident(d.Name)
+		p.lbrace(d.Lbrace)
+		if len(d.Values) > 0 || p.hasComments(d.Rbrace) {
+			p.indent++
+			for _, v := range d.Values {
+				p.linebreak(v.Pos())
+				p.ident(v.Name)
+				if v.Value != nil {
+					p.write(" = ")
+					p.expr(v.Value)
+				}
+				if v.Comma != ast.NoPos {
+					p.token(v.Comma, ",")
+				}
+			}
+			p.linebreak(d.Rbrace)
+			p.indent--
+		}
+		p.token(d.Rbrace, "}")
+	case *ast.DefaultDecl:
+		p.token(d.Default, "default")
+		p.write(" ")
+		p.expr(d.Name)
+		p.write(" = ")
+		p.expr(d.Value)
+		p.token(d.Semi, ";")
+	case *ast.DefaultsDecl:
+		p.token(d.Defaults, "defaults")
+		p.block(d.Body)
+	case *ast.HintDecl:
+		p.token(d.Hint, "hint")
+		p.write(" ")
+		p.ident(d.Name)
+		p.write(" = ")
+		p.expr(d.Value)
+		p.token(d.Semi, ";")
+	case *ast.AutobindDecl:
+		p.mods(d.Mods)
+		p.token(d.Autobind, "autobind")
+		p.write(" ")
+		p.ident(d.Name)
+		p.write(": ")
+		p.expr(d.Type)
+		p.write(" = ")
+		p.expr(d.Value)
+		p.token(d.Semi, ";")
+	case *ast.EmptyDecl:
+		p.token(d.Semi, ";")
+	}
+}
+
+// ----------------------------------------------------------------------------
+// Statements
+
+// lbrace prints the opening brace at pos after the construct it opens,
+// moving it to a line of its own if BraceNextLine is set.
+func (p *printer) lbrace(pos lex.Pos) {
+	switch {
+	case p.bol:
+	case p.BraceNextLine:
+		p.flush(pos)
+		if !p.bol {
+			p.newline(0)
+		}
+	default:
+		p.write(" ")
+	}
+	p.token(pos, "{")
+}
+
+func (p *printer) block(b *ast.BlockStmt) {
+	p.lbrace(b.Lbrace)
+	if len(b.List) > 0 || p.hasComments(b.Rbrace) {
+		p.indent++
+		p.stmtList(b.List)
+		p.linebreak(b.Rbrace)
+		p.indent--
+	}
+	p.token(b.Rbrace, "}")
+}
+
+// stmtList prints statements one per line. A lone semicolon stays on the
+// line of the statement before it.
+func (p *printer) stmtList(list []ast.Stmt) {
+	for i, s := range list {
+		if _, ok := s.(*ast.EmptyStmt); !ok || i == 0 {
+			p.linebreak(s.Pos())
+		}
+		p.stmt(s)
+	}
+}
+
+// afterBlock separates the keyword at pos, else or while, from the body
+// before it: by a space after a block, unless a // comment follows the
+// block, and by a new line otherwise.
+func (p *printer) afterBlock(body ast.Stmt, pos lex.Pos) {
+	if _, ok := body.(*ast.BlockStmt); !ok || p.BraceNextLine {
+		p.linebreak(pos)
+		return
+	}
+	p.write(" ")
+	p.flush(pos)
+	if p.lineComment {
+		p.newline(0)
+	}
+}
+
+// body prints the body of a control statement. A block stays on the line
+// of the statement; anything else is indented on the next line.
+func (p *printer) body(s ast.Stmt) {
+	if b, ok := s.(*ast.BlockStmt); ok {
+		p.block(b)
+		return
+	}
+	p.indent++
+	p.linebreak(s.Pos())
+	p.stmt(s)
+	p.indent--
+}
+
+// semi prints the semicolon at pos if the statement has one.
+func (p *printer) semi(pos lex.Pos) {
+	if pos != ast.NoPos {
+		p.token(pos, ";")
+	}
+}
+
+func (p *printer) stmt(s ast.Stmt) {
+	switch s := s.(type) {
+	case *ast.BlockStmt:
+		p.block(s)
+	case *ast.ExprStmt:
+		p.expr(s.X)
+		p.semi(s.Semi)
+	case *ast.AssignStmt:
+		p.expr(s.Lhs)
+		p.write(" ")
+		p.token(s.TokPos, s.Tok)
+		p.write(" ")
+		p.expr(s.Rhs)
+		p.semi(s.Semi)
+	case *ast.DeclStmt:
+		p.decl(s.Decl)
+	case *ast.EmptyStmt:
+		p.token(s.Semi, ";")
+	case *ast.IfStmt:
+		p.token(s.If, "if")
+		p.write(" (")
+		p.expr(s.Cond)
+		p.write(")")
+		p.body(s.Body)
+		if s.Else == nil {
+			break
+		}
+		p.afterBlock(s.Body, s.ElsePos)
+		p.token(s.ElsePos, "else")
+		if _, ok := s.Else.(*ast.IfStmt); ok {
+			p.write(" ")
+			p.stmt(s.Else)
+		} else {
+			p.body(s.Else)
+		}
+	case *ast.WhileStmt:
+		p.token(s.While, "while")
+		p.write(" (")
+		p.expr(s.Cond)
+		p.write(")")
+		p.body(s.Body)
+	case *ast.DoWhileStmt:
+		p.token(s.Do, "do")
+		p.body(s.Body)
+		p.afterBlock(s.Body, s.While)
+		p.token(s.While, "while")
+		p.write(" (")
+		p.expr(s.Cond)
+		p.write(")")
+		p.token(s.Semi, ";")
+	case *ast.ForStmt:
+		p.token(s.For, "for")
+		p.write(" (")
+		if s.Init != nil {
+			p.stmt(s.Init)
+		}
+		p.write(";")
+		if s.Cond != nil {
+			p.write(" ")
+			p.expr(s.Cond)
+		}
+		p.write(";")
+		if s.Post != nil {
+			p.write(" ")
+			p.stmt(s.Post)
+		}
+		p.write(")")
+		p.body(s.Body)
+	case *ast.SwitchStmt:
+		p.token(s.Switch, "switch")
+		p.write(" (")
+		p.expr(s.Tag)
+		p.write(")")
+		p.lbrace(s.Lbrace)
+		for _, c := range s.Body {
+			p.linebreak(c.Pos())
+			if c.Value != nil {
+				p.token(c.Case, "case")
+				p.write(" ")
+				p.expr(c.Value)
+			} else {
+				p.token(c.Case, "default")
+			}
+			p.token(c.Colon, ":")
+			p.indent++
+			p.stmtList(c.Body)
+			p.indent--
+		}
+		p.linebreak(s.Rbrace)
+		p.token(s.Rbrace, "}")
+	case *ast.ReturnStmt:
+		p.token(s.Return, "return")
+		if s.Result != nil {
+			p.write(" ")
+			p.expr(s.Result)
+		}
+		p.token(s.Semi, ";")
+	case *ast.BranchStmt:
+		p.token(s.TokPos, lex.Rkey[s.Tok])
+		p.token(s.Semi, ";")
+	case *ast.DeleteStmt:
+		p.token(s.Delete, "delete")
+		p.write(" ")
+		p.expr(s.X)
+		p.token(s.Semi, ";")
+	}
+}
+
+// ----------------------------------------------------------------------------
+// Expressions
+
+func (p *printer) ident(x *ast.Ident) {
+	p.token(x.NamePos, x.Name)
+}
+
+func (p *printer) expr(x ast.Expr) {
+	switch x := x.(type) {
+	case *ast.Ident:
+		p.ident(x)
+	case *ast.BasicLit:
+		p.token(x.ValuePos, x.Value)
+	case *ast.ParenExpr:
+		p.token(x.Lparen, "(")
+		p.expr(x.X)
+		p.token(x.Rparen, ")")
+	case *ast.SelectorExpr:
+		p.expr(x.X)
+		p.write(".")
+		p.ident(x.Sel)
+	case *ast.IndexExpr:
+		p.expr(x.X)
+		p.token(x.Lbrack, "[")
+		p.expr(x.Index)
+		p.token(x.Rbrack, "]")
+	case *ast.CallExpr:
+		p.expr(x.Fun)
+		p.token(x.Lparen, "(")
+		for i, arg := range x.Args {
+			if i > 0 {
+				p.token(x.Commas[i-1], ",")
+				p.write(" ")
+			}
+			if arg != nil {
+				p.expr(arg)
+			}
+		}
+		p.token(x.Rparen, ")")
+	case *ast.UnaryExpr:
+		p.token(x.OpPos, x.Op)
+		p.apart(x.Op, x.X)
+		p.expr(x.X)
+	case *ast.IncDecExpr:
+		if x.Post {
+			p.expr(x.X)
+			p.token(x.TokPos, x.Tok)
+		} else {
+			p.token(x.TokPos, x.Tok)
+			p.apart(x.Tok, x.X)
+			p.expr(x.X)
+		}
+	case *ast.BinaryExpr:
+		p.expr(x.X)
+		p.write(" ")
+		p.token(x.OpPos, x.Op)
+		p.write(" ")
+		p.expr(x.Y)
+	case *ast.CondExpr:
+		p.expr(x.Cond)
+		p.write(" ? ")
+		p.expr(x.X)
+		p.write(" : ")
+		p.expr(x.Y)
+	case *ast.NewExpr:
+		p.token(x.New, "new")
+		p.write(" ")
+		p.expr(x.Type)
+		if x.Owner != nil {
+			p.write(" in ")
+			p.expr(x.Owner)
+		}
+	case *ast.CastExpr:
+		p.token(x.Lparen, "(")
+		p.expr(x.Type)
+		p.write(")")
+		p.expr(x.X)
+	case *ast.ArrayType:
+		p.token(x.Array, "array")
+		p.write("<")
+		p.expr(x.Elem)
+		p.token(x.Gt, ">")
+	}
+}
+
+// apart writes a space between the prefix operator op and its operand x
+// if x starts with an operator that would otherwise lex together with op,
+// as in - -c.
+func (p *printer) apart(op string, x ast.Expr) {
+	var next string
+	switch x := x.(type) {
+	case *ast.UnaryExpr:
+		next = x.Op
+	case *ast.IncDecExpr:
+		if !x.Post {
+			next = x.Tok
+		}
+	}
+	if next == "" {
+		return
+	}
+	if _, ok := lex.Operator(op + next[:1]); ok {
+		p.write(" ")
+	}
+}
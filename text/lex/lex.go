@@ -13,9 +13,12 @@ import (
 
 // Item represents a token or text string returned from the scanner.
 type Item struct {
-	Typ ItemType // The type of this item.
-	Pos Pos      // The starting position, in bytes, of this item in the input string.
-	Val string   // The value of this item.
+	Typ  ItemType // The type of this item.
+	Pos  Pos      // The starting position, in bytes, of this item in the input string.
+	End  Pos      // The position, in bytes, just past the end of this item.
+	Line int      // The line number of the start of this item, starting at 1.
+	Col  int      // The column, in runes, of the start of this item, starting at 1.
+	Val  string   // The value of this item.
 }
 
 func (i Item) String() string {
@@ -33,13 +36,26 @@ func (i Item) String() string {
 	return fmt.Sprintf("%q\t%s", i.Val, Rkey[i.Typ])
 }
 
+// Same reports whether i and j are the same token. Tokens whose text can
+// vary must also have the same text, ignoring carriage returns.
+func (i Item) Same(j Item) bool {
+	if i.Typ != j.Typ {
+		return false
+	}
+	switch i.Typ {
+	case ItemIdentifier, ItemChar, ItemCharConstant, ItemString, ItemName, ItemBool, ItemComment, ItemModifiers, ItemNumber:
+		return strings.Replace(i.Val, "\r", "", -1) == strings.Replace(j.Val, "\r", "", -1)
+	}
+	return true
+}
+
 // ItemType identifies the type of lex items.
 type ItemType int
 
 const (
 	ItemError        ItemType = iota // error occurred; value is text of error
 	ItemBool                         // boolean constant
-	ItemChar                         // printable ASCII character; grab bag for comma etc.
+	ItemChar                         // comma or semicolon
 	ItemCharConstant                 // character constant
 	ItemComplex                      // complex constant (1+2i); imaginary is just a number
 	ItemColonEquals                  // colon-equals (':=') introducing a declaration
@@ -56,12 +72,46 @@ const (
 	ItemSpace      // run of spaces separating arguments
 	ItemNewline    // newline
 	ItemString     // quoted string (includes quotes)
+	ItemName       // name literal in single quotes (includes quotes)
 	ItemText       // plain text
 	ItemVariable   // variable starting with '$', such as '$' or  '$1' or '$hello'
 	ItemLeftBrace
 	ItemRightBrace
+	ItemLeftBracket  // '['
+	ItemRightBracket // ']'
 	ItemComment
-	ItemOperator
+	ItemQuestion // '?'
+	ItemColon    // ':'
+	// Operators appear after ItemOperator and before the keywords.
+	ItemOperator     // used only to delimit the operators
+	ItemLogicalAnd   // &&
+	ItemLogicalOr    // ||
+	ItemEqual        // ==
+	ItemNotEqual     // !=
+	ItemLessEqual    // <=
+	ItemGreaterEqual // >=
+	ItemAddAssign    // +=
+	ItemSubAssign    // -=
+	ItemMulAssign    // *=
+	ItemDivAssign    // /=
+	ItemModAssign    // %=
+	ItemAndAssign    // &=
+	ItemOrAssign     // |=
+	ItemIncrement    // ++
+	ItemDecrement    // --
+	ItemAdd          // +
+	ItemSub          // -
+	ItemMul          // *
+	ItemDiv          // /
+	ItemMod          // %
+	ItemNot          // !
+	ItemAssign       // =
+	ItemLess         // <
+	ItemGreater      // >
+	ItemAnd          // &
+	ItemOr           // |
+	ItemXor          // ^
+	ItemTilde        // ~
 	// Keywords appear after all the rest.
 	ItemKeyword  // used only to delimit the keywords
 	ItemDot      // the cursor, spelled '.'
@@ -88,6 +138,25 @@ const (
 	ItemClass    // class keyword
 	ItemArray    // array keyword
 	ItemModifiers
+	ItemState         // state keyword
+	ItemExtends       // extends keyword
+	ItemIn            // in keyword
+	ItemNew           // new keyword
+	ItemDelete        // delete keyword
+	ItemThis          // this keyword
+	ItemSuper         // super keyword
+	ItemParent        // parent keyword
+	ItemVirtualParent // virtual_parent keyword
+	ItemNULL          // NULL constant
+	ItemLatent        // latent keyword
+	ItemCleanup       // cleanup keyword
+	ItemReward        // reward keyword
+	ItemHint          // hint keyword
+	ItemDefault       // default keyword
+	ItemDefaults      // defaults keyword
+	ItemAutobind      // autobind keyword
+	ItemOptional      // optional keyword
+	ItemSingle        // single keyword
 )
 
 var key = map[string]ItemType{
@@ -100,65 +169,231 @@ var key = map[string]ItemType{
 	// "nil": ItemNil,
 	// "template": ItemTemplate,
 	// "with":     ItemWith,
-	"for":    ItemFor, // ws keywords
-	"switch": ItemSwitch,
-	"case":   ItemCase,
-	"while":  ItemWhile,
-	"return": ItemReturn,
-	// "break":  ItemBreak,
-	// "continue":     ItemContinue,
-	"var":      ItemVar,
-	"enum":     ItemEnum,
-	"struct":   ItemStruct,
-	"function": ItemFunction,
-	// "event":        ItemEvent,
-	// "class":        ItemClass,
-	"array":        ItemArray,
-	"abstract":     ItemModifiers, // ws modifiers
-	"entry":        ItemModifiers,
-	"out":          ItemModifiers,
-	"saved":        ItemModifiers,
-	"storyscene":   ItemModifiers,
-	"quest":        ItemModifiers,
-	"exec":         ItemModifiers,
-	"timer":        ItemModifiers,
-	"final":        ItemModifiers,
-	"import":       ItemModifiers,
-	"const":        ItemModifiers,
-	"editable":     ItemModifiers,
-	"default":      ItemModifiers,
-	"statemachine": ItemModifiers,
-	"private":      ItemModifiers,
-	"protected":    ItemModifiers,
-	"public":       ItemModifiers,
+	"for":            ItemFor, // ws keywords
+	"switch":         ItemSwitch,
+	"case":           ItemCase,
+	"while":          ItemWhile,
+	"return":         ItemReturn,
+	"break":          ItemBreak,
+	"continue":       ItemContinue,
+	"var":            ItemVar,
+	"enum":           ItemEnum,
+	"struct":         ItemStruct,
+	"function":       ItemFunction,
+	"event":          ItemEvent,
+	"class":          ItemClass,
+	"state":          ItemState,
+	"extends":        ItemExtends,
+	"in":             ItemIn,
+	"new":            ItemNew,
+	"delete":         ItemDelete,
+	"this":           ItemThis,
+	"super":          ItemSuper,
+	"parent":         ItemParent,
+	"virtual_parent": ItemVirtualParent,
+	"NULL":           ItemNULL,
+	"latent":         ItemLatent,
+	"cleanup":        ItemCleanup,
+	"reward":         ItemReward,
+	"hint":           ItemHint,
+	"default":        ItemDefault,
+	"defaults":       ItemDefaults,
+	"autobind":       ItemAutobind,
+	"optional":       ItemOptional,
+	"single":         ItemSingle,
+	"array":          ItemArray,
+	"abstract":       ItemModifiers, // ws modifiers
+	"entry":          ItemModifiers,
+	"out":            ItemModifiers,
+	"saved":          ItemModifiers,
+	"storyscene":     ItemModifiers,
+	"quest":          ItemModifiers,
+	"exec":           ItemModifiers,
+	"timer":          ItemModifiers,
+	"final":          ItemModifiers,
+	"import":         ItemModifiers,
+	"const":          ItemModifiers,
+	"editable":       ItemModifiers,
+	"statemachine":   ItemModifiers,
+	"private":        ItemModifiers,
+	"protected":      ItemModifiers,
+	"public":         ItemModifiers,
+}
+
+// operators maps the text of each operator to its item type. lexOperator
+// takes the longest operator that matches, so "=!" is "=" followed by "!"
+// and "||!" is "||" followed by "!".
+var operators = map[string]ItemType{
+	"&&": ItemLogicalAnd,
+	"||": ItemLogicalOr,
+	"==": ItemEqual,
+	"!=": ItemNotEqual,
+	"<=": ItemLessEqual,
+	">=": ItemGreaterEqual,
+	"+=": ItemAddAssign,
+	"-=": ItemSubAssign,
+	"*=": ItemMulAssign,
+	"/=": ItemDivAssign,
+	"%=": ItemModAssign,
+	"&=": ItemAndAssign,
+	"|=": ItemOrAssign,
+	"++": ItemIncrement,
+	"--": ItemDecrement,
+	"+":  ItemAdd,
+	"-":  ItemSub,
+	"*":  ItemMul,
+	"/":  ItemDiv,
+	"%":  ItemMod,
+	"!":  ItemNot,
+	"=":  ItemAssign,
+	"<":  ItemLess,
+	">":  ItemGreater,
+	"&":  ItemAnd,
+	"|":  ItemOr,
+	"^":  ItemXor,
+	"~":  ItemTilde,
+	"?":  ItemQuestion,
+	":":  ItemColon,
+}
+
+// Operator returns the type of the operator spelled s. ok is false if s is
+// not an operator.
+func Operator(s string) (t ItemType, ok bool) {
+	t, ok = operators[s]
+	return t, ok
+}
+
+// IsOperator reports whether t is the type of an operator. The ? and : of
+// conditional expressions are not counted, as : also ends labels and
+// declarations.
+func (t ItemType) IsOperator() bool {
+	return ItemOperator < t && t < ItemKeyword
+}
+
+// Precedence returns the precedence of the binary operator t, from 1 for
+// || to 9 for the multiplicative operators, or 0 if t is not a binary
+// operator.
+func (t ItemType) Precedence() int {
+	switch t {
+	case ItemLogicalOr:
+		return 1
+	case ItemLogicalAnd:
+		return 2
+	case ItemOr:
+		return 3
+	case ItemXor:
+		return 4
+	case ItemAnd:
+		return 5
+	case ItemEqual, ItemNotEqual:
+		return 6
+	case ItemLess, ItemLessEqual, ItemGreater, ItemGreaterEqual:
+		return 7
+	case ItemAdd, ItemSub:
+		return 8
+	case ItemMul, ItemDiv, ItemMod:
+		return 9
+	}
+	return 0
 }
 
 var Rkey = map[ItemType]string{
-	ItemError:        "error",
-	ItemBool:         "bool",
-	ItemChar:         "char",
-	ItemCharConstant: "charConstant",
-	ItemComplex:      "complex",
-	ItemColonEquals:  "colonEquals",
-	ItemEOF:          "EOF",
-	ItemField:        "field",
-	ItemIdentifier:   "identifier",
-	ItemLeftDelim:    "leftDelim",
-	ItemLeftParen:    "leftParen",
-	ItemNumber:       "number",
-	ItemPipe:         "pipe",
-	ItemRawString:    "rawString",
-	ItemRightDelim:   "rightDelim",
-	ItemRightParen:   "rightParen",
-	ItemSpace:        "space",
-	ItemNewline:      "newline",
-	ItemString:       "string",
-	ItemText:         "text",
-	ItemVariable:     "variable",
-	ItemOperator:     "operator",
-	ItemModifiers:    "modifier",
-	ItemLeftBrace:    "leftBrace",
-	ItemRightBrace:   "rightBrace",
+	ItemError:         "error",
+	ItemBool:          "bool",
+	ItemChar:          "char",
+	ItemCharConstant:  "charConstant",
+	ItemComplex:       "complex",
+	ItemColonEquals:   "colonEquals",
+	ItemEOF:           "EOF",
+	ItemField:         "field",
+	ItemIdentifier:    "identifier",
+	ItemLeftDelim:     "leftDelim",
+	ItemLeftParen:     "leftParen",
+	ItemNumber:        "number",
+	ItemPipe:          "pipe",
+	ItemRawString:     "rawString",
+	ItemRightDelim:    "rightDelim",
+	ItemRightParen:    "rightParen",
+	ItemSpace:         "space",
+	ItemNewline:       "newline",
+	ItemString:        "string",
+	ItemName:          "name",
+	ItemText:          "text",
+	ItemVariable:      "variable",
+	ItemOperator:      "operator",
+	ItemQuestion:      "question",
+	ItemColon:         "colon",
+	ItemLogicalAnd:    "logicalAnd",
+	ItemLogicalOr:     "logicalOr",
+	ItemEqual:         "equal",
+	ItemNotEqual:      "notEqual",
+	ItemLessEqual:     "lessEqual",
+	ItemGreaterEqual:  "greaterEqual",
+	ItemAddAssign:     "addAssign",
+	ItemSubAssign:     "subAssign",
+	ItemMulAssign:     "mulAssign",
+	ItemDivAssign:     "divAssign",
+	ItemModAssign:     "modAssign",
+	ItemAndAssign:     "andAssign",
+	ItemOrAssign:      "orAssign",
+	ItemIncrement:     "increment",
+	ItemDecrement:     "decrement",
+	ItemAdd:           "add",
+	ItemSub:           "sub",
+	ItemMul:           "mul",
+	ItemDiv:           "div",
+	ItemMod:           "mod",
+	ItemNot:           "not",
+	ItemAssign:        "assign",
+	ItemLess:          "less",
+	ItemGreater:       "greater",
+	ItemAnd:           "and",
+	ItemOr:            "or",
+	ItemXor:           "xor",
+	ItemTilde:         "tilde",
+	ItemModifiers:     "modifier",
+	ItemLeftBrace:     "leftBrace",
+	ItemRightBrace:    "rightBrace",
+	ItemLeftBracket:   "leftBracket",
+	ItemRightBracket:  "rightBracket",
+	ItemComment:       "comment",
+	ItemDot:           "dot",
+	ItemDefine:        "define",
+	ItemElse:          "else",
+	ItemIf:            "if",
+	ItemFor:           "for",
+	ItemSwitch:        "switch",
+	ItemCase:          "case",
+	ItemWhile:         "while",
+	ItemReturn:        "return",
+	ItemBreak:         "break",
+	ItemContinue:      "continue",
+	ItemVar:           "var",
+	ItemEnum:          "enum",
+	ItemStruct:        "struct",
+	ItemFunction:      "function",
+	ItemEvent:         "event",
+	ItemClass:         "class",
+	ItemArray:         "array",
+	ItemState:         "state",
+	ItemExtends:       "extends",
+	ItemIn:            "in",
+	ItemNew:           "new",
+	ItemDelete:        "delete",
+	ItemThis:          "this",
+	ItemSuper:         "super",
+	ItemParent:        "parent",
+	ItemVirtualParent: "virtual_parent",
+	ItemNULL:          "NULL",
+	ItemLatent:        "latent",
+	ItemCleanup:       "cleanup",
+	ItemReward:        "reward",
+	ItemHint:          "hint",
+	ItemDefault:       "default",
+	ItemDefaults:      "defaults",
+	ItemAutobind:      "autobind",
+	ItemOptional:      "optional",
+	ItemSingle:        "single",
 }
 
 const eof = -1
@@ -176,18 +411,25 @@ type stateFn func(*Lexer) stateFn
 
 // Lexer holds the state of the scanner.
 type Lexer struct {
-	name       string    // the name of the input; used only for error reports
-	input      string    // the string being scanned
-	leftDelim  string    // start of action
-	rightDelim string    // end of action
-	state      stateFn   // the next lexing function to enter
-	pos        Pos       // current position in the input
-	start      Pos       // start position of this item
-	width      Pos       // width of last rune read from input
-	lastPos    Pos       // position of most recent item returned by nextItem
-	items      chan Item // channel of scanned items
-	parenDepth int       // nesting depth of ( ) exprs
-	braceDepth int       // nesting depth of { }
+	name         string   // the name of the input; used only for error reports
+	input        string   // the string being scanned
+	file         *File    // line table of the input
+	leftDelim    string   // start of action
+	rightDelim   string   // end of action
+	state        stateFn  // the next lexing function to enter
+	pos          Pos      // current position in the input
+	start        Pos      // start position of this item
+	width        Pos      // width of last rune read from input
+	line         int      // line number of start
+	col          int      // rune column of start
+	items        []Item   // scanned items not yet returned by NextItem
+	parenDepth   int      // nesting depth of ( ) exprs
+	braceDepth   int      // nesting depth of { }
+	bracketDepth int      // nesting depth of [ ]
+	angleDepth   int      // nesting depth of array< >
+	prev         ItemType // type of the last item that is not space, a newline or a comment
+	recovery     bool     // go on scanning after an error
+	errs         []*Error // errors scanned so far
 }
 
 // next returns the next rune in the input.
@@ -218,12 +460,37 @@ func (l *Lexer) backup() {
 
 // emit passes an item back to the client.
 func (l *Lexer) emit(t ItemType) {
-	l.items <- Item{t, l.start, l.input[l.start:l.pos]}
-	l.start = l.pos
+	l.items = append(l.items, Item{
+		Typ:  t,
+		Pos:  l.start,
+		End:  l.pos,
+		Line: l.line,
+		Col:  l.col,
+		Val:  l.input[l.start:l.pos],
+	})
+	switch t {
+	case ItemSpace, ItemNewline, ItemComment:
+	default:
+		l.prev = t
+	}
+	l.advance()
 }
 
 // ignore skips over the pending input before this point.
 func (l *Lexer) ignore() {
+	l.advance()
+}
+
+// advance moves start up to pos, keeping the line and column of start
+// current.
+func (l *Lexer) advance() {
+	s := l.input[l.start:l.pos]
+	if i := strings.LastIndexByte(s, '\n'); i >= 0 {
+		l.line += strings.Count(s, "\n")
+		l.col = 1 + utf8.RuneCountInString(s[i+1:])
+	} else {
+		l.col += utf8.RuneCountInString(s)
+	}
 	l.start = l.pos
 }
 
@@ -243,52 +510,128 @@ func (l *Lexer) acceptRun(valid string) {
 	l.backup()
 }
 
-// lineNumber reports which line we're on, based on the position of
-// the previous item returned by nextItem. Doing it this way
-// means we don't have to worry about peek double counting.
-func (l *Lexer) lineNumber() int {
-	return 1 + strings.Count(l.input[:l.lastPos], "\n")
+// File returns the line table of the input being scanned.
+func (l *Lexer) File() *File {
+	return l.file
 }
 
-// errorf returns an error token and terminates the scan by passing
-// back a nil pointer that will be the next state, terminating l.nextItem.
-func (l *Lexer) errorf(format string, args ...interface{}) stateFn {
-	l.items <- Item{ItemError, l.start, fmt.Sprintf(format, args...)}
-	return nil
+// Position returns the position of the start of item i.
+func (l *Lexer) Position(i Item) Position {
+	return Position{
+		Filename: l.name,
+		Offset:   int(i.Pos),
+		Line:     i.Line,
+		Column:   i.Col,
+	}
 }
 
-// nextItem returns the next item from the input.
-// Called by the parser, not in the lexing goroutine.
-func (l *Lexer) NextItem() Item {
-	item := <-l.items
-	l.lastPos = item.Pos
-	return item
+// Error is a lexical error.
+type Error struct {
+	Pos  Position // start of the offending text
+	Text string   // the offending text; empty for errors such as an unclosed paren at the end
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Pos, e.Msg)
+}
+
+// SetRecovery sets whether the scan goes on after a lexical error. With
+// recovery the error item is followed by the items after the offending
+// text, which ends at the next space, newline or delimiter. Without it, the
+// default, the error item is the last item before EOF. The setting is kept
+// by Reset.
+func (l *Lexer) SetRecovery(on bool) {
+	l.recovery = on
+}
+
+// Errors returns the lexical errors scanned so far. Once NextItem has
+// returned EOF it holds every error in the input, of which there is at
+// most one without recovery.
+func (l *Lexer) Errors() []*Error {
+	return l.errs
 }
 
-// drain drains the output so the lexing goroutine will exit.
-// Called by the parser, not in the lexing goroutine.
-func (l *Lexer) drain() {
-	for range l.items {
+// errorf emits an error item. Without recovery it terminates the scan by
+// passing back a nil pointer that will be the next state, terminating
+// l.nextItem. With recovery the rest of a partly scanned item is skipped
+// and the scan goes on.
+func (l *Lexer) errorf(format string, args ...interface{}) stateFn {
+	if l.recovery && l.pos > l.start {
+		l.skipToDelim()
+	}
+	item := Item{
+		Typ:  ItemError,
+		Pos:  l.start,
+		End:  l.pos,
+		Line: l.line,
+		Col:  l.col,
+		Val:  fmt.Sprintf(format, args...),
+	}
+	l.items = append(l.items, item)
+	l.errs = append(l.errs, &Error{Pos: l.Position(item), Text: l.input[item.Pos:item.End], Msg: item.Val})
+	if !l.recovery {
+		return nil
 	}
+	l.advance()
+	return lexInsideAction
 }
 
-// lex creates a new scanner for the input string.
-func Lex(name, input string) *Lexer {
-	l := &Lexer{
-		name:  name,
-		input: input,
-		items: make(chan Item),
+// skipToDelim advances to the next space, newline or delimiter, or to the
+// end of the input.
+func (l *Lexer) skipToDelim() {
+	for {
+		switch r := l.peek(); {
+		case r == eof, isSpace(r), isEndOfLine(r), strings.ContainsRune("(){}[];,", r):
+			return
+		}
+		l.next()
 	}
-	go l.run()
-	return l
 }
 
-// run runs the state machine for the lexer.
-func (l *Lexer) run() {
-	for l.state = lexInsideAction; l.state != nil; {
+// NextItem returns the next item from the input. The state machine is run
+// on demand until it has produced at least one item. Once the scan has
+// terminated every further call returns an EOF item.
+func (l *Lexer) NextItem() Item {
+	for len(l.items) == 0 {
+		if l.state == nil {
+			return Item{Typ: ItemEOF, Pos: l.pos, End: l.pos, Line: l.line, Col: l.col}
+		}
 		l.state = l.state(l)
 	}
-	close(l.items)
+	item := l.items[0]
+	l.items = append(l.items[:0], l.items[1:]...)
+	return item
+}
+
+// Close stops the scan and releases the input and its line table. Calling
+// NextItem on a closed Lexer returns an EOF item until Reset is called.
+func (l *Lexer) Close() {
+	l.state = nil
+	l.input = ""
+	l.file = nil
+	l.items = l.items[:0]
+}
+
+// Reset prepares the Lexer to scan a new input, reusing its buffers.
+func (l *Lexer) Reset(name, input string) {
+	*l = Lexer{
+		name:     name,
+		input:    input,
+		file:     NewFile(name, input),
+		items:    l.items[:0],
+		state:    lexInsideAction,
+		line:     1,
+		col:      1,
+		recovery: l.recovery,
+	}
+}
+
+// Lex creates a new scanner for the input string.
+func Lex(name, input string) *Lexer {
+	l := &Lexer{}
+	l.Reset(name, input)
+	return l
 }
 
 // state functions
@@ -303,6 +646,8 @@ func lexComment(l *Lexer) stateFn {
 	l.pos += Pos(len(leftComment))
 	i := strings.Index(l.input[l.pos:], rightComment)
 	if i < 0 {
+		// the comment runs to the end of the input
+		l.pos = Pos(len(l.input))
 		return l.errorf("unclosed comment")
 	}
 	l.pos += Pos(i + len(rightComment))
@@ -317,11 +662,11 @@ func lexComment(l *Lexer) stateFn {
 
 // lexSingleLineComment scans until the end of the line
 func lexSingleLineComment(l *Lexer) stateFn {
-	i := strings.Index(l.input[l.pos:], "\n")
-	if i < 0 {
+	if i := strings.Index(l.input[l.pos:], "\n"); i < 0 {
 		l.pos = Pos(len(l.input))
+	} else {
+		l.pos += Pos(i)
 	}
-	l.pos += Pos(i)
 
 	l.emit(ItemComment)
 	return lexInsideAction
@@ -334,11 +679,17 @@ func lexInsideAction(l *Lexer) stateFn {
 	// Pipe symbols separate and are emitted.
 	switch r := l.next(); {
 	case r == eof:
-		if l.parenDepth != 0 {
-			return l.errorf("unclosed left paren")
-		}
-		if l.braceDepth != 0 {
+		// the depths are cleared so that with recovery each is reported once
+		switch {
+		case l.parenDepth != 0:
+			l.parenDepth = 0
 			return l.errorf("unclosed left paren")
+		case l.braceDepth != 0:
+			l.braceDepth = 0
+			return l.errorf("unclosed left brace")
+		case l.bracketDepth != 0:
+			l.bracketDepth = 0
+			return l.errorf("unclosed left bracket")
 		}
 		l.emit(ItemEOF)
 		return nil
@@ -357,7 +708,7 @@ func lexInsideAction(l *Lexer) stateFn {
 	case r == '$':
 		return lexVariable
 	case r == '\'':
-		return lexChar
+		return lexName
 	case r == '.':
 		// special look-ahead for ".field" so we don't break l.backup().
 		r = l.peek()
@@ -381,6 +732,7 @@ func lexInsideAction(l *Lexer) stateFn {
 		l.emit(ItemRightParen)
 		l.parenDepth--
 		if l.parenDepth < 0 {
+			l.parenDepth = 0
 			return l.errorf("unexpected right paren %#U", r)
 		}
 	case r == '{':
@@ -390,20 +742,45 @@ func lexInsideAction(l *Lexer) stateFn {
 		l.emit(ItemRightBrace)
 		l.braceDepth--
 		if l.braceDepth < 0 {
+			l.braceDepth = 0
 			return l.errorf("unexpected right brace %#U", r)
 		}
-	case r <= unicode.MaxASCII && unicode.IsPrint(r):
+	case r == '[':
+		l.emit(ItemLeftBracket)
+		l.bracketDepth++
+	case r == ']':
+		l.emit(ItemRightBracket)
+		l.bracketDepth--
+		if l.bracketDepth < 0 {
+			l.bracketDepth = 0
+			return l.errorf("unexpected right bracket %#U", r)
+		}
+	case r == ',' || r == ';':
 		l.emit(ItemChar)
-		return lexInsideAction
 	default:
 		return l.errorf("unrecognized character in action: %#U", r)
 	}
 	return lexInsideAction
 }
 
+// lexOperator scans an operator. Its first character has already been
+// seen. The angle brackets of array<T> are always single characters, so
+// the closers of array<array<T>>= are ">", ">" and "=".
 func lexOperator(l *Lexer) stateFn {
-	l.acceptRun("%&*/!+=-|")
-	l.emit(ItemOperator)
+	r := l.input[l.start]
+	switch {
+	case r == '<' && l.prev == ItemArray:
+		l.angleDepth++
+	case r == '>' && l.angleDepth > 0:
+		l.angleDepth--
+	default:
+		if end := int(l.pos) + 1; end <= len(l.input) {
+			if _, ok := operators[l.input[l.start:end]]; ok {
+				l.pos++
+			}
+		}
+	}
+	l.emit(operators[l.input[l.start:l.pos]])
 	return lexInsideAction
 }
 
@@ -523,26 +900,21 @@ func (l *Lexer) atTerminator() bool {
 	return false
 }
 
-// lexChar scans a character constant. The initial quote is already
-// scanned. Syntax checking is done by the parser.
-func lexChar(l *Lexer) stateFn {
-Loop:
+// lexName scans a name literal such as 'Geralt'. The opening quote has
+// already been seen. Like the game compiler it takes everything up to the
+// next quote on the same line: there are no escapes, and a name may be
+// empty or contain spaces.
+func lexName(l *Lexer) stateFn {
 	for {
 		switch l.next() {
-		case '\\':
-			if r := l.next(); r != eof && r != '\n' {
-				break
-			}
-			fallthrough
 		case eof, '\n':
-			return l.errorf("unterminated character constant")
+			l.backup()
+			return l.errorf("unterminated name")
 		case '\'':
-			break Loop
+			l.emit(ItemName)
+			return lexInsideAction
 		}
 	}
-	l.emit(ItemString)
-	// l.emit(ItemCharConstant)
-	return lexInsideAction
 }
 
 // lexNumber scans a number: decimal, octal, hex, float, or imaginary. This
@@ -595,6 +967,7 @@ Loop:
 			}
 			fallthrough
 		case eof, '\n':
+			l.backup()
 			return l.errorf("unterminated quoted string")
 		case '"':
 			break Loop
@@ -634,6 +1007,7 @@ func isAlphaNumeric(r rune) bool {
 	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
 }
 
+// isOperator reports whether r starts an operator.
 func isOperator(r rune) bool {
-	return strings.IndexRune("%&*/!+=-|<>", r) >= 0
+	return strings.IndexRune("%&*/!+=-|<>^~?:", r) >= 0
 }
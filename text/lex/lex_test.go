@@ -0,0 +1,364 @@
+package lex
+
+import (
+	"strings"
+	"testing"
+)
+
+// corpusSnippet is a vanilla-style script used to build a large input for
+// the benchmarks.
+const corpusSnippet = `// ---------------------------------------------------------------------------
+statemachine class CR4Player extends CPlayer
+{
+	private var inv : CInventoryComponent;
+	private saved var buffs : array<CBaseGameplayEffect>;
+	default autoState = 'Exploration';
+
+	event OnSpawned( spawnData : SEntitySpawnData )
+	{
+		var i : int;
+		super.OnSpawned( spawnData );
+		for ( i = 0; i < buffs.Size(); i += 1 )
+		{
+			if ( buffs[i] && !buffs[i].IsActive() || i >= 10 )
+			{
+				buffs.Erase( i );
+				i -= 1;
+			}
+		}
+		theGame.GetGuiManager().ShowNotification( "Loaded: " + i, 3000 );
+	}
+
+	/* cleanup after combat */
+	latent function Cleanup( optional force : bool ) : bool
+	{
+		var x : float = 1.5f * 0x1F;
+		return force || x != 0.0;
+	}
+}
+`
+
+// corpus returns about n bytes of script.
+func corpus(n int) string {
+	return strings.Repeat(corpusSnippet, n/len(corpusSnippet)+1)
+}
+
+func BenchmarkLex(b *testing.B) {
+	src := corpus(1 << 20)
+	b.SetBytes(int64(len(src)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		l := Lex("bench.ws", src)
+		for t := l.NextItem(); t.Typ != ItemEOF; t = l.NextItem() {
+			if t.Typ == ItemError {
+				b.Fatalf("%s: %s", l.Position(t), t.Val)
+			}
+		}
+		l.Close()
+	}
+}
+
+// BenchmarkNextItem reuses a single Lexer through Reset, as a tool
+// formatting many files in one process does.
+func BenchmarkNextItem(b *testing.B) {
+	src := corpus(1 << 20)
+	b.SetBytes(int64(len(src)))
+	b.ReportAllocs()
+	l := Lex("bench.ws", "")
+	for i := 0; i < b.N; i++ {
+		l.Reset("bench.ws", src)
+		for t := l.NextItem(); t.Typ != ItemEOF; t = l.NextItem() {
+		}
+	}
+	l.Close()
+}
+
+// items returns the types of the items of l up to and including EOF.
+func items(l *Lexer) []ItemType {
+	var typs []ItemType
+	for {
+		t := l.NextItem()
+		typs = append(typs, t.Typ)
+		if t.Typ == ItemEOF {
+			return typs
+		}
+	}
+}
+
+func TestCloseReset(t *testing.T) {
+	l := Lex("a.ws", "x = 1;")
+	if got := l.NextItem(); got.Typ != ItemIdentifier || got.Val != "x" {
+		t.Fatalf("first item = %v, want identifier x", got)
+	}
+	l.Close()
+	if l.File() != nil {
+		t.Errorf("File after Close is not nil")
+	}
+	for i := 0; i < 3; i++ {
+		if got := l.NextItem(); got.Typ != ItemEOF {
+			t.Fatalf("NextItem after Close = %v, want EOF", got)
+		}
+	}
+
+	l.Reset("b.ws", "y = 2;")
+	want := items(Lex("b.ws", "y = 2;"))
+	got := items(l)
+	if len(got) != len(want) {
+		t.Fatalf("after Reset got %d items, want %d", len(got), len(want))
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("item %d after Reset = %s, want %s", i, Rkey[got[i]], Rkey[want[i]])
+		}
+	}
+	if p := l.Position(Item{Line: 1, Col: 1}); p.Filename != "b.ws" {
+		t.Errorf("file name after Reset = %q, want b.ws", p.Filename)
+	}
+	if f := l.File(); f == nil || f.Name != "b.ws" {
+		t.Errorf("File after Reset = %+v, want the line table of b.ws", f)
+	}
+
+	// a Reset in the middle of a scan drops the items of the old input
+	l.Reset("c.ws", "a b c")
+	l.NextItem()
+	l.Reset("d.ws", "z")
+	if got := l.NextItem(); got.Val != "z" {
+		t.Errorf("first item after second Reset = %v, want z", got)
+	}
+	if got := l.NextItem(); got.Typ != ItemEOF {
+		t.Errorf("second item after second Reset = %v, want EOF", got)
+	}
+}
+
+type tok struct {
+	typ ItemType
+	val string
+}
+
+// keywordTests are vanilla script snippets covering every WitcherScript
+// keyword.
+var keywordTests = []struct {
+	src  string
+	want []tok
+}{
+	{"statemachine class CR4Player extends CPlayer {}", []tok{
+		{ItemModifiers, "statemachine"}, {ItemClass, "class"}, {ItemIdentifier, "CR4Player"},
+		{ItemExtends, "extends"}, {ItemIdentifier, "CPlayer"}, {ItemLeftBrace, "{"}, {ItemRightBrace, "}"},
+	}},
+	{"state Combat in CR4Player extends ExtendedMovable {}", []tok{
+		{ItemState, "state"}, {ItemIdentifier, "Combat"}, {ItemIn, "in"}, {ItemIdentifier, "CR4Player"},
+		{ItemExtends, "extends"}, {ItemIdentifier, "ExtendedMovable"}, {ItemLeftBrace, "{"}, {ItemRightBrace, "}"},
+	}},
+	{"event OnSpawned( spawnData : SEntitySpawnData )", []tok{
+		{ItemEvent, "event"}, {ItemIdentifier, "OnSpawned"}, {ItemLeftParen, "("}, {ItemIdentifier, "spawnData"},
+		{ItemColon, ":"}, {ItemIdentifier, "SEntitySpawnData"}, {ItemRightParen, ")"},
+	}},
+	{"latent function WaitForAnim( optional timeout : float ) : bool", []tok{
+		{ItemLatent, "latent"}, {ItemFunction, "function"}, {ItemIdentifier, "WaitForAnim"}, {ItemLeftParen, "("},
+		{ItemOptional, "optional"}, {ItemIdentifier, "timeout"}, {ItemColon, ":"}, {ItemIdentifier, "float"},
+		{ItemRightParen, ")"}, {ItemColon, ":"}, {ItemIdentifier, "bool"},
+	}},
+	{"cleanup function OnLeaveState()", []tok{
+		{ItemCleanup, "cleanup"}, {ItemFunction, "function"}, {ItemIdentifier, "OnLeaveState"},
+		{ItemLeftParen, "("}, {ItemRightParen, ")"},
+	}},
+	{"private autobind inv : CInventoryComponent = single;", []tok{
+		{ItemModifiers, "private"}, {ItemAutobind, "autobind"}, {ItemIdentifier, "inv"}, {ItemColon, ":"},
+		{ItemIdentifier, "CInventoryComponent"}, {ItemAssign, "="}, {ItemSingle, "single"}, {ItemChar, ";"},
+	}},
+	{"default autoState = 'Exploration';", []tok{
+		{ItemDefault, "default"}, {ItemIdentifier, "autoState"}, {ItemAssign, "="}, {ItemName, "'Exploration'"}, {ItemChar, ";"},
+	}},
+	{"defaults { autoState = 'Idle'; }", []tok{
+		{ItemDefaults, "defaults"}, {ItemLeftBrace, "{"}, {ItemIdentifier, "autoState"}, {ItemAssign, "="},
+		{ItemName, "'Idle'"}, {ItemChar, ";"}, {ItemRightBrace, "}"},
+	}},
+	{`hint radius = "Radius of the area";`, []tok{
+		{ItemHint, "hint"}, {ItemIdentifier, "radius"}, {ItemAssign, "="}, {ItemString, `"Radius of the area"`}, {ItemChar, ";"},
+	}},
+	{"reward function GiveReward()", []tok{
+		{ItemReward, "reward"}, {ItemFunction, "function"}, {ItemIdentifier, "GiveReward"}, {ItemLeftParen, "("}, {ItemRightParen, ")"},
+	}},
+	{"ent = new CEntity in this;", []tok{
+		{ItemIdentifier, "ent"}, {ItemAssign, "="}, {ItemNew, "new"}, {ItemIdentifier, "CEntity"},
+		{ItemIn, "in"}, {ItemThis, "this"}, {ItemChar, ";"},
+	}},
+	{"delete buff;", []tok{{ItemDelete, "delete"}, {ItemIdentifier, "buff"}, {ItemChar, ";"}}},
+	{"super.OnSpawned( spawnData );", []tok{
+		{ItemSuper, "super"}, {ItemDot, "."}, {ItemIdentifier, "OnSpawned"}, {ItemLeftParen, "("},
+		{ItemIdentifier, "spawnData"}, {ItemRightParen, ")"}, {ItemChar, ";"},
+	}},
+	{"parent.OnCombatActionEnd();", []tok{
+		{ItemParent, "parent"}, {ItemDot, "."}, {ItemIdentifier, "OnCombatActionEnd"}, {ItemLeftParen, "("},
+		{ItemRightParen, ")"}, {ItemChar, ";"},
+	}},
+	{"virtual_parent.PopState( true );", []tok{
+		{ItemVirtualParent, "virtual_parent"}, {ItemDot, "."}, {ItemIdentifier, "PopState"}, {ItemLeftParen, "("},
+		{ItemBool, "true"}, {ItemRightParen, ")"}, {ItemChar, ";"},
+	}},
+	{"while ( npc != NULL ) { if ( dead ) break; else continue; }", []tok{
+		{ItemWhile, "while"}, {ItemLeftParen, "("}, {ItemIdentifier, "npc"}, {ItemNotEqual, "!="}, {ItemNULL, "NULL"},
+		{ItemRightParen, ")"}, {ItemLeftBrace, "{"}, {ItemIf, "if"}, {ItemLeftParen, "("}, {ItemIdentifier, "dead"},
+		{ItemRightParen, ")"}, {ItemBreak, "break"}, {ItemChar, ";"}, {ItemElse, "else"}, {ItemContinue, "continue"},
+		{ItemChar, ";"}, {ItemRightBrace, "}"},
+	}},
+	{"for ( i = 0; i < buffs.Size(); i += 1 )", []tok{
+		{ItemFor, "for"}, {ItemLeftParen, "("}, {ItemIdentifier, "i"}, {ItemAssign, "="}, {ItemNumber, "0"},
+		{ItemChar, ";"}, {ItemIdentifier, "i"}, {ItemLess, "<"}, {ItemIdentifier, "buffs"}, {ItemDot, "."},
+		{ItemIdentifier, "Size"}, {ItemLeftParen, "("}, {ItemRightParen, ")"}, {ItemChar, ";"},
+		{ItemIdentifier, "i"}, {ItemAddAssign, "+="}, {ItemNumber, "1"}, {ItemRightParen, ")"},
+	}},
+	{"switch ( dir ) { case 0: return; default: }", []tok{
+		{ItemSwitch, "switch"}, {ItemLeftParen, "("}, {ItemIdentifier, "dir"}, {ItemRightParen, ")"}, {ItemLeftBrace, "{"},
+		{ItemCase, "case"}, {ItemNumber, "0"}, {ItemColon, ":"}, {ItemReturn, "return"}, {ItemChar, ";"},
+		{ItemDefault, "default"}, {ItemColon, ":"}, {ItemRightBrace, "}"},
+	}},
+	{"var buffs : array< CBaseGameplayEffect >; struct SItem {} enum EDir {}", []tok{
+		{ItemVar, "var"}, {ItemIdentifier, "buffs"}, {ItemColon, ":"}, {ItemArray, "array"}, {ItemLess, "<"},
+		{ItemIdentifier, "CBaseGameplayEffect"}, {ItemGreater, ">"}, {ItemChar, ";"},
+		{ItemStruct, "struct"}, {ItemIdentifier, "SItem"}, {ItemLeftBrace, "{"}, {ItemRightBrace, "}"},
+		{ItemEnum, "enum"}, {ItemIdentifier, "EDir"}, {ItemLeftBrace, "{"}, {ItemRightBrace, "}"},
+	}},
+}
+
+func TestKeywords(t *testing.T) {
+	for _, test := range keywordTests {
+		l := Lex("test.ws", test.src)
+		var got []Item
+		for it := l.NextItem(); it.Typ != ItemEOF; it = l.NextItem() {
+			if it.Typ == ItemError {
+				t.Fatalf("%q: %s", test.src, it.Val)
+			}
+			if it.Typ != ItemSpace && it.Typ != ItemNewline {
+				got = append(got, it)
+			}
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%q: got %d tokens, want %d", test.src, len(got), len(test.want))
+			continue
+		}
+		for i, w := range test.want {
+			g := got[i]
+			if g.Typ != w.typ || g.Val != w.val {
+				t.Errorf("%q: token %d = %s %q, want %s %q", test.src, i, Rkey[g.Typ], g.Val, Rkey[w.typ], w.val)
+			}
+			// keywords are named after their spelling
+			if w.typ > ItemKeyword && w.typ != ItemModifiers && w.typ != ItemDot && Rkey[g.Typ] != w.val {
+				t.Errorf("%q: Rkey of %q = %q", test.src, w.val, Rkey[g.Typ])
+			}
+		}
+	}
+}
+
+// TestKeywordCoverage checks that every keyword in key has its own item
+// type, named in Rkey after its spelling, and appears in keywordTests.
+func TestKeywordCoverage(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, test := range keywordTests {
+		for _, w := range test.want {
+			seen[w.val] = true
+		}
+	}
+	types := make(map[ItemType]string)
+	for word, typ := range key {
+		if typ == ItemModifiers || typ == ItemDot || typ == ItemDefine {
+			continue
+		}
+		if other, ok := types[typ]; ok {
+			t.Errorf("%q and %q share item type %d", word, other, typ)
+		}
+		types[typ] = word
+		if Rkey[typ] != word {
+			t.Errorf("Rkey of %q = %q", word, Rkey[typ])
+		}
+		if !seen[word] {
+			t.Errorf("keyword %q is not covered by keywordTests", word)
+		}
+	}
+}
+
+// TestInvalidCharacters checks that printable characters WitcherScript
+// does not use are lexical errors, each reported once in recovery mode.
+func TestInvalidCharacters(t *testing.T) {
+	for _, c := range []string{"#", "@", `\`} {
+		src := "x = a " + c + " b;"
+		l := Lex("a.ws", src)
+		var last Item
+		for last = l.NextItem(); last.Typ != ItemEOF && last.Typ != ItemError; last = l.NextItem() {
+		}
+		if last.Typ != ItemError || last.Col != 7 {
+			t.Errorf("%q: last item = %v at column %d, want an error at column 7", src, last, last.Col)
+		}
+	}
+
+	l := Lex("a.ws", "x = a # b;\ny = c @ d;\n")
+	l.SetRecovery(true)
+	for t := l.NextItem(); t.Typ != ItemEOF; t = l.NextItem() {
+	}
+	errs := l.Errors()
+	if len(errs) != 2 || errs[0].Pos.Line != 1 || errs[1].Pos.Line != 2 {
+		t.Errorf("recovery errors = %v, want one on line 1 and one on line 2", errs)
+	}
+}
+
+// TestPositions checks the positions the lexer gives items and the line
+// table of its File: columns count runes, a CRLF ends one line, and a
+// multi-line comment moves the items after it to later lines.
+func TestPositions(t *testing.T) {
+	src := "a\ns = \"żółw\";\r\n/* x\n yy */ b\n"
+	want := []struct {
+		val       string
+		pos, end  Pos
+		line, col int
+	}{
+		{"a", 0, 1, 1, 1},
+		{"s", 2, 3, 2, 1},
+		{"=", 4, 5, 2, 3},
+		{"\"żółw\"", 6, 15, 2, 5},
+		{";", 15, 16, 2, 11},
+		{"/* x\n yy */", 18, 29, 3, 1},
+		{"b", 30, 31, 4, 8},
+	}
+	l := Lex("a.ws", src)
+	f := l.File()
+	var got []Item
+	for it := l.NextItem(); it.Typ != ItemEOF; it = l.NextItem() {
+		if it.Typ == ItemError {
+			t.Fatalf("error item %v", it)
+		}
+		if it.Typ != ItemSpace && it.Typ != ItemNewline {
+			got = append(got, it)
+		}
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d items, want %d", len(got), len(want))
+	}
+	for i, w := range want {
+		it := got[i]
+		if it.Val != w.val || it.Pos != w.pos || it.End != w.end || it.Line != w.line || it.Col != w.col {
+			t.Errorf("item %d = %q at %d-%d, %d:%d, want %q at %d-%d, %d:%d",
+				i, it.Val, it.Pos, it.End, it.Line, it.Col, w.val, w.pos, w.end, w.line, w.col)
+		}
+		if p := f.Position(it.Pos); p.Line != w.line || p.Column != w.col || p.Offset != int(w.pos) {
+			t.Errorf("Position(%d) = %+v, want %d:%d", it.Pos, p, w.line, w.col)
+		}
+		if off := f.Offset(w.line, w.col); off != w.pos {
+			t.Errorf("Offset(%d, %d) = %d, want %d", w.line, w.col, off, w.pos)
+		}
+	}
+
+	for _, test := range []struct {
+		line int
+		want Pos
+	}{{0, 0}, {1, 0}, {2, 2}, {3, 18}, {4, 23}, {5, 32}, {6, 32}} {
+		if got := f.LineStart(test.line); got != test.want {
+			t.Errorf("LineStart(%d) = %d, want %d", test.line, got, test.want)
+		}
+	}
+	if p := f.Position(9); p.Line != 2 || p.Column != 7 {
+		t.Errorf("Position(9) = %d:%d, want 2:7", p.Line, p.Column)
+	}
+	if off := f.Offset(2, 100); off != 17 {
+		t.Errorf("Offset past the end of line 2 = %d, want 17", off)
+	}
+}
@@ -0,0 +1,104 @@
+package lex
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Position describes a location in an input file.
+type Position struct {
+	Filename string // name of the input, if any
+	Offset   int    // byte offset, starting at 0
+	Line     int    // line number, starting at 1
+	Column   int    // column number in runes, starting at 1
+}
+
+// IsValid reports whether the position has a line number.
+func (p Position) IsValid() bool {
+	return p.Line > 0
+}
+
+// String returns the position formatted as file:line:col. The file name is
+// left out when it is empty.
+func (p Position) String() string {
+	s := p.Filename
+	if p.IsValid() {
+		if s != "" {
+			s += ":"
+		}
+		s += fmt.Sprintf("%d:%d", p.Line, p.Column)
+	}
+	if s == "" {
+		s = "-"
+	}
+	return s
+}
+
+// File maps byte offsets of an input to line and column positions.
+type File struct {
+	Name  string // name of the input; used in positions
+	src   string
+	lines []int // offset of the first byte of each line
+}
+
+// NewFile returns a File for the named input.
+func NewFile(name, src string) *File {
+	f := &File{Name: name, src: src, lines: []int{0}}
+	for i := 0; ; {
+		n := strings.IndexByte(src[i:], '\n')
+		if n < 0 {
+			break
+		}
+		i += n + 1
+		f.lines = append(f.lines, i)
+	}
+	return f
+}
+
+// LineCount returns the number of lines in the file.
+func (f *File) LineCount() int {
+	return len(f.lines)
+}
+
+// LineStart returns the offset of the first byte of the given 1-based line.
+// Lines past the end of the file map to the end of the input.
+func (f *File) LineStart(line int) Pos {
+	switch {
+	case line < 1:
+		return 0
+	case line > len(f.lines):
+		return Pos(len(f.src))
+	}
+	return Pos(f.lines[line-1])
+}
+
+// Offset returns the byte offset of the 1-based line and rune column.
+// Columns past the end of the line map to the end of the line.
+func (f *File) Offset(line, col int) Pos {
+	p := int(f.LineStart(line))
+	for ; col > 1 && p < len(f.src) && f.src[p] != '\n'; col-- {
+		_, w := utf8.DecodeRuneInString(f.src[p:])
+		p += w
+	}
+	return Pos(p)
+}
+
+// Position returns the position of the byte offset p.
+func (f *File) Position(p Pos) Position {
+	off := int(p)
+	if off < 0 {
+		return Position{Filename: f.Name}
+	}
+	if off > len(f.src) {
+		off = len(f.src)
+	}
+	line := sort.Search(len(f.lines), func(i int) bool { return f.lines[i] > off })
+	return Position{
+		Filename: f.Name,
+		Offset:   off,
+		Line:     line,
+		Column:   utf8.RuneCountInString(f.src[f.lines[line-1]:off]) + 1,
+	}
+}
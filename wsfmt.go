@@ -1,571 +1,377 @@
 package main
 
 import (
+	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 
-	"golang.org/x/text/encoding/unicode"
-	"golang.org/x/text/transform"
+	"timmy.narnian.us/git/timmy/wsfmt/config"
+	"timmy.narnian.us/git/timmy/wsfmt/diff"
+	"timmy.narnian.us/git/timmy/wsfmt/format"
+	"timmy.narnian.us/git/timmy/wsfmt/lsp"
+	"timmy.narnian.us/git/timmy/wsfmt/parser"
 	"timmy.narnian.us/git/timmy/wsfmt/text/lex"
 )
 
-type stateFn func(*Formatter) stateFn
-
-type Formatter struct {
-	l             *lex.Lexer
-	previousToken lex.Item
-	token         lex.Item
-	nextToken     lex.Item
-	state         stateFn
-	maxNewlines   int
-	newlineCount  int
-	parenDepth    int
-	Output        strings.Builder
-	scopeLevel    []int
-	// Each index is one scope deep delimited by braces or case statement.
-	// the number is how many 'soft' scopes deep it is resets to 1 on newline e.g. an if statement without braces
-}
+// Exit codes. When several apply the highest one is used.
+const (
+	exitOK          = 0
+	exitUnformatted = 1 // -l or -d found a file that is not formatted
+	exitSyntax      = 2 // a file could not be parsed
+	exitError       = 3 // usage, read or write errors
+	exitVerify      = 4 // -verify found a result that does not match its source
+)
 
 var (
-	blank  = lex.Item{Pos: -1}
-	b      []byte
-	fmtErr error
+	list        = flag.Bool("l", false, "list files whose formatting differs from wsfmt's")
+	write       = flag.Bool("w", false, "write result to (source) file instead of stdout")
+	doDiff      = flag.Bool("d", false, "display diffs instead of rewriting files")
+	printCfg    = flag.Bool("print-config", false, "print the effective settings for each path and exit")
+	verify      = flag.Bool("verify", false, "check that the result has the same tokens as the source and formats to itself; write nothing if not")
+	encoding    = flag.String("encoding", "auto", "output `encoding`: auto, utf-8 or utf-16le")
+	eol         = flag.String("eol", "auto", "output line `ending`: auto, lf or crlf")
+	maxNewlines = flag.Int("maxnewlines", format.DefaultMaxNewlines, "maximum number of consecutive `newlines` kept")
+	width       = flag.Int("width", 0, "maximum line `width`, counting tabs as 4 columns; 0 means no limit")
+	lines       = flag.String("lines", "", "format only the statements overlapping `first:last`, counting lines from 1")
+	useAST      = flag.Bool("ast", false, "format by parsing into a syntax tree and printing it")
+	indent      format.Indent
+	braceStyle  format.BraceStyle
+
+	opts      format.Options // options from the command line
+	firstLine int            // first line of -lines; 0 formats whole files
+	lastLine  int
+	configs   config.Loader
+	exitCode  = exitOK
 )
 
-func main() {
-
-	file, _ := os.Open(os.Args[1])
-	f := Format(file)
-	f.run()
-	fmt.Println(f.Output.String())
-	if fmtErr != nil {
-		os.Stdout.Sync()
-		fmt.Fprintln(os.Stderr, "\n", fmtErr)
-		os.Exit(1)
-	}
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: wsfmt [flags] [path ...]")
+	fmt.Fprintln(os.Stderr, "       wsfmt lsp")
+	flag.PrintDefaults()
 }
 
-func Format(text io.Reader) (f *Formatter) {
-	var err error
-	FILE := transform.NewReader(text, unicode.BOMOverride(unicode.UTF8.NewDecoder().Transformer))
-	b, err = ioutil.ReadAll(FILE)
-	if err != nil {
-		panic(err)
+func main() {
+	if len(os.Args) == 2 && os.Args[1] == "lsp" {
+		if err := lsp.NewServer(os.Stdin, os.Stdout).Run(); err != nil {
+			fmt.Fprintln(os.Stderr, "wsfmt lsp:", err)
+			os.Exit(1)
+		}
+		return
 	}
-	f = &Formatter{}
-	f.l = lex.Lex("name", string(b))
-	f.maxNewlines = 3
-	f.nextToken = blank
-	return f
-}
 
-func (f *Formatter) next() lex.Item {
-	f.previousToken = f.token
-	var temp lex.Item
+	flag.Var(&indent, "indent", "`indentation`: tab, or a number of spaces")
+	flag.Var(&braceStyle, "brace", "brace `style`: same-line or next-line")
+	flag.Usage = usage
+	flag.Parse()
 
-	if f.nextToken == blank {
-		temp = f.l.NextItem()
-	} else {
-		temp = f.nextToken
-		f.nextToken = blank
+	var err error
+	opts.Encoding, err = format.ParseEncoding(*encoding)
+	if err != nil || opts.Encoding == format.UTF16BE {
+		fmt.Fprintln(os.Stderr, "wsfmt: -encoding must be auto, utf-8 or utf-16le")
+		os.Exit(exitError)
 	}
-	for ; temp.Typ == lex.ItemSpace || temp.Typ == lex.ItemNewline; temp = f.l.NextItem() {
+	opts.EOL, err = format.ParseLineEnding(*eol)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "wsfmt: -eol must be auto, lf or crlf")
+		os.Exit(exitError)
 	}
 
-	f.token = temp
-	return f.token
-}
-
-func (f *Formatter) peek() lex.Item {
-	if f.nextToken == blank {
-		temp := f.l.NextItem()
-		count := 0
-		for ; temp.Typ == lex.ItemSpace || temp.Typ == lex.ItemNewline; temp = f.l.NextItem() {
-			if temp.Typ == lex.ItemNewline {
-				count += strings.Count(temp.Val, "\n")
-			}
-		}
-		if count < 3 {
-			f.newlineCount = count
-		} else {
-			f.newlineCount = 3
-		}
-		f.nextToken = temp
+	if *maxNewlines < 1 {
+		fmt.Fprintln(os.Stderr, "wsfmt: -maxnewlines must be at least 1")
+		os.Exit(exitError)
 	}
-	return f.nextToken
-}
 
-func (f *Formatter) run() {
-	for f.state = format; f.state != nil; {
-		f.state = f.state(f)
+	if *width < 0 {
+		fmt.Fprintln(os.Stderr, "wsfmt: -width must not be negative")
+		os.Exit(exitError)
 	}
-}
-
-func errorf(format string, args ...interface{}) stateFn {
-	fmtErr = fmt.Errorf(format, args...)
-	return nil
-}
 
-func format(f *Formatter) stateFn {
-	switch t := f.next().Typ; {
-	case t == lex.ItemEOF:
-		return nil
-	case t == lex.ItemError:
-		return errorf("error: %s", f.token.Val)
-	case t == lex.ItemComment:
-		f.printComment()
-	case t == lex.ItemFunction:
-		return formatFunction
-	case t == lex.ItemIf, t == lex.ItemWhile, t == lex.ItemFor, t == lex.ItemSwitch:
-		return formatConditional
-	case t == lex.ItemElse:
-		if f.previousToken.Typ == lex.ItemRightBrace {
-			f.Output.WriteString(" else")
-		} else {
-			f.Output.WriteString("else")
-		}
-		if f.peek().Typ != lex.ItemLeftBrace && f.peek().Typ != lex.ItemIf {
-			f.scopeLevel[len(f.scopeLevel)-1]++
-			printNewline(f)
-			printTab(f)
+	if *lines != "" {
+		if firstLine, lastLine, err = parseLines(*lines); err != nil {
+			fmt.Fprintln(os.Stderr, "wsfmt: -lines must be first:last with 1 <= first <= last")
+			os.Exit(exitError)
 		}
-	case t == lex.ItemReturn:
-		f.Output.WriteString(f.token.Val + " ")
-	case t == lex.ItemModifiers, t == lex.ItemIdentifier, t == lex.ItemNumber, t == lex.ItemBool, t == lex.ItemString:
-		if !printIdentifier(f) {
-			return errorf("invalid identifier: trailing dot '.'")
+		if flag.NArg() > 1 {
+			fmt.Fprintln(os.Stderr, "wsfmt: cannot use -lines with more than one path")
+			os.Exit(exitError)
 		}
-	case isChar(t):
-		return printChar(f)
-	case t == lex.ItemStruct:
-		return formatStruct
-	case t == lex.ItemVar:
-		return formatVar
-	case t == lex.ItemOperator:
-		printOperator(f)
-	case t == lex.ItemArray:
-		return formatArray
-	case t == lex.ItemCase:
-		return formatCase
-	case t == lex.ItemEnum:
-		return formatEnum
-	default:
-		return errorf("expected Identifier got %s: %s\n", lex.Rkey[f.token.Typ], f.token.Val)
-	}
-	return format
-}
-
-func (f *Formatter) printComment() {
-	f.Output.WriteString(f.token.Val)
-	printNewline(f)
-}
-
-func formatFunction(f *Formatter) stateFn {
-	if f.token.Typ == lex.ItemFunction {
-		f.Output.WriteString(f.token.Val + " ")
 	}
 
-	switch t := f.next().Typ; {
-	case t == lex.ItemEOF:
-		return errorf("unexpected EOF wanted identifier\n")
-	case t == lex.ItemComment:
-		f.printComment()
-	case t == lex.ItemIdentifier:
-		if !printIdentifier(f) {
-			return errorf("invalid identifier: trailing dot '.'")
+	if *printCfg {
+		paths := flag.Args()
+		if len(paths) == 0 {
+			paths = []string{"."}
 		}
-		if f.next().Typ == lex.ItemLeftParen {
-			printChar(f)
-			return format
+		for i, path := range paths {
+			if i > 0 {
+				fmt.Println()
+			}
+			printConfig(path)
 		}
-		return errorf("expected left Parenthesis got %s: %s\n", lex.Rkey[f.token.Typ], f.token.Val)
+		os.Exit(exitCode)
 	}
-	return errorf("expected Identifier got %s: %s\n", lex.Rkey[f.token.Typ], f.token.Val)
-}
 
-func formatStruct(f *Formatter) stateFn {
-	if f.token.Typ == lex.ItemStruct {
-		if !printIdentifier(f) {
-			return errorf("invalid identifier: trailing dot '.'")
+	if flag.NArg() == 0 {
+		if *write {
+			fmt.Fprintln(os.Stderr, "wsfmt: cannot use -w with standard input")
+			os.Exit(exitError)
 		}
-	}
-	switch t := f.next().Typ; {
-	case t == lex.ItemEOF:
-		return errorf("unexpected EOF wanted identifier\n")
-	case t == lex.ItemComment:
-		f.printComment()
-	case t == lex.ItemIdentifier:
-		if !printIdentifier(f) {
-			return errorf("invalid identifier: trailing dot '.'")
+		src, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			report(err, exitError)
+		} else if s := settings("<standard input>"); s != nil {
+			processFile("<standard input>", src, nil, s.Options)
 		}
-		return format
-	default:
-		return errorf("expected Identifier got %s: %s\n", lex.Rkey[f.token.Typ], f.token.Val)
+		os.Exit(exitCode)
 	}
-	return formatStruct
-}
 
-func formatVar(f *Formatter) stateFn {
-	if !printIdentifier(f) {
-		return errorf("invalid identifier: trailing dot '.'")
-	}
-	for notdone := true; notdone; {
-		if f.next().Typ == lex.ItemIdentifier {
-			if !printIdentifier(f) {
-				return errorf("invalid identifier: trailing dot '.'")
-			}
-			if f.next().Typ == lex.ItemChar {
-				switch f.token.Val {
-				case ",":
-					printChar(f)
-				case ":":
-					printChar(f)
-					notdone = false
-				default:
-					return errorf("expected Identifier got %s: %s\n", lex.Rkey[f.token.Typ], f.token.Val)
-
-				}
-			} else {
-				return errorf("expected Identifier got %s: %s\n", lex.Rkey[f.token.Typ], f.token.Val)
-
-			}
-		} else {
-			return errorf("expected Identifier got %s: %s\n", lex.Rkey[f.token.Typ], f.token.Val)
-
-		}
-	}
-	switch f.next().Typ {
-	case lex.ItemIdentifier:
-		if !printIdentifier(f) {
-			return errorf("invalid identifier: trailing dot '.'")
+	for _, path := range flag.Args() {
+		switch info, err := os.Stat(path); {
+		case err != nil:
+			report(err, exitError)
+		case info.IsDir() && firstLine > 0:
+			report(fmt.Errorf("%s: cannot use -lines with a directory", path), exitError)
+		case info.IsDir():
+			walkDir(path)
+		default:
+			processPath(path, info)
 		}
-	case lex.ItemArray:
-		return formatArray // errorf("Bad array syntax")
-	default:
-		return errorf("expected Identifier got %s: %s\n", lex.Rkey[f.token.Typ], f.token.Val)
-
 	}
-	return format
+	os.Exit(exitCode)
 }
 
-func printIdentifier(f *Formatter) bool {
-	switch i := f.peek(); {
-	case i.Val == "{", i.Val == "}", i.Val == "(", i.Val == ")", i.Val == "[", i.Val == "]", i.Val == "|", i.Val == ",", i.Val == ":", i.Val == ";":
-		f.Output.WriteString(f.token.Val)
-	case i.Typ == lex.ItemDot:
-		f.Output.WriteString(f.token.Val)
-		f.next()
-		return printDot(f)
-	default:
-		f.Output.WriteString(f.token.Val + " ")
-	}
-	return true
-}
-
-func printDot(f *Formatter) bool {
-	f.Output.WriteString(".")
-	if f.peek().Typ == lex.ItemIdentifier {
-		f.next()
-		return printIdentifier(f)
+// parseLines parses the argument of -lines.
+func parseLines(s string) (first, last int, err error) {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return 0, 0, fmt.Errorf("missing colon in %q", s)
 	}
-	return false
-}
-
-func printOperator(f *Formatter) {
-	str := "%s"
-	switch f.token.Val {
-	case "|", "!":
-	case "+", "-":
-		switch f.previousToken.Typ {
-		case lex.ItemLeftParen, lex.ItemOperator, lex.ItemReturn, lex.ItemCase:
-		default:
-			str = "%s "
-		}
-	default:
-		str = "%s "
+	if first, err = strconv.Atoi(s[:i]); err != nil {
+		return 0, 0, err
 	}
-	switch f.previousToken.Val {
-	case ")", "]":
-		str = " " + str
+	if last, err = strconv.Atoi(s[i+1:]); err != nil {
+		return 0, 0, err
 	}
-	f.Output.WriteString(fmt.Sprintf(str, f.token.Val))
-}
-
-func formatConditional(f *Formatter) stateFn {
-	switch f.token.Typ {
-	case lex.ItemIf, lex.ItemWhile, lex.ItemFor, lex.ItemSwitch:
-		if f.previousToken.Typ == lex.ItemElse {
-			f.Output.WriteString(" ")
-		}
-		if f.next().Typ != lex.ItemLeftParen {
-			return errorf("expected parenthesis got %s: %s\n", lex.Rkey[f.token.Typ], f.token.Val)
-		}
-		f.Output.WriteString(f.previousToken.Val + " (")
-		f.parenDepth = 1
+	if first < 1 || last < first {
+		return 0, 0, fmt.Errorf("invalid range %q", s)
 	}
+	return first, last, nil
+}
 
-	switch t := f.next().Typ; {
-	case t == lex.ItemEOF:
-		return errorf("unexpected EOF wanted identifier\n")
-	case t == lex.ItemComment:
-		f.printComment()
-	case t == lex.ItemOperator:
-		printOperator(f)
-	case t == lex.ItemIdentifier, t == lex.ItemNumber, t == lex.ItemString, t == lex.ItemBool:
-		if !printIdentifier(f) {
-			return errorf("expected Identifier got %s: %s\n", lex.Rkey[f.token.Typ], f.token.Val)
-		}
-	case isChar(t):
-		if f.token.Val == ";" {
-			f.Output.WriteString("; ")
-		} else {
-			printChar(f)
+// applyFlags sets the options given on the command line, which take
+// precedence over configuration files.
+func applyFlags(opts *format.Options) {
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "indent":
+			opts.Indent = indent
+		case "brace":
+			opts.BraceStyle = braceStyle
+		case "maxnewlines":
+			opts.MaxNewlines = *maxNewlines
+		case "width":
+			opts.Width = *width
+		case "ast":
+			opts.AST = *useAST
 		}
-		switch f.token.Val {
-		case ")":
-			f.parenDepth--
-			if f.parenDepth == 0 {
-				if f.peek().Typ != lex.ItemLeftBrace {
-					f.scopeLevel[len(f.scopeLevel)-1]++
-					printNewline(f)
-					printTab(f)
-				}
-				return format
-			}
-		case "(":
-			f.parenDepth++
-		}
-	}
-	return formatConditional
+	})
 }
 
-func formatNewLine(f *Formatter) stateFn {
-
-	switch t := f.peek().Typ; {
-	case t == lex.ItemEOF:
-		f.Output.WriteString("\n")
+// settings returns the settings for the file or directory name, or nil
+// after reporting an error in a configuration file.
+func settings(name string) *config.Settings {
+	s, err := configs.Resolve(name, opts)
+	if err != nil {
+		report(err, exitError)
 		return nil
-	case t == lex.ItemError:
-		return errorf("error: " + f.token.Val)
-	case t == lex.ItemCase:
-		printNewline(f)
-		f.scopeLevel = f.scopeLevel[:len(f.scopeLevel)-1]
-		printTab(f)
-	case f.peek().Val == ";" || f.peek().Val == "}":
-	default:
-		printNewline(f)
-		printTab(f)
 	}
-
-	return format
+	applyFlags(&s.Options)
+	return s
 }
 
-func formatEnum(f *Formatter) stateFn {
-	if !printIdentifier(f) {
-		return errorf("invalid identifier: trailing dot '.'")
+// printConfig prints the settings for name in configuration file syntax.
+func printConfig(name string) {
+	s := settings(name)
+	if s == nil {
+		return
 	}
-	if f.next().Typ != lex.ItemIdentifier {
-		return errorf("expected Identifier got %s: %s\n", lex.Rkey[f.token.Typ], f.token.Val)
+	fmt.Printf("# %s\n", name)
+	for _, c := range s.Configs {
+		fmt.Printf("# from %s\n", c.Path())
 	}
-	if !printIdentifier(f) {
-		return errorf("expected Identifier got %s: %s\n", lex.Rkey[f.token.Typ], f.token.Val)
+	if s.Excluded != nil {
+		fmt.Printf("# excluded by %q in %s\n", s.Pattern, s.Excluded.Path())
 	}
-	if f.next().Typ != lex.ItemLeftBrace {
-		return errorf("expected left brace got %s: %s\n", lex.Rkey[f.token.Typ], f.token.Val)
+	if s.Options.MaxNewlines == 0 {
+		s.Options.MaxNewlines = format.DefaultMaxNewlines
+	}
+	fmt.Printf("max_newlines = %d\n", s.Options.MaxNewlines)
+	if s.Options.Indent.Spaces == 0 {
+		fmt.Printf("indent = %q\n", s.Options.Indent)
+	} else {
+		fmt.Printf("indent = %d\n", s.Options.Indent.Spaces)
 	}
+	fmt.Printf("brace_style = %q\n", s.Options.BraceStyle)
+	fmt.Printf("width = %d\n", s.Options.Width)
+	fmt.Printf("ast = %t\n", s.Options.AST)
+}
 
-	f.scopeLevel = append(f.scopeLevel, 1)
-	f.Output.WriteString(" {")
-	printNewline(f)
-	printTab(f)
-	return formatEnumIdent
+// report prints err and raises the exit code to at least code.
+func report(err error, code int) {
+	fmt.Fprintln(os.Stderr, err)
+	setExit(code)
 }
 
-func formatEnumIdent(f *Formatter) stateFn {
-	if f.next().Typ != lex.ItemIdentifier {
-		return errorf("expected Identifier got %s: %s\n", lex.Rkey[f.token.Typ], f.token.Val)
-	}
-	if !printIdentifier(f) {
-		return errorf("expected Identifier got %s: %s\n", lex.Rkey[f.token.Typ], f.token.Val)
-	}
-	switch f.peek().Val {
-	case "=":
-		f.next()
-		printOperator(f)
-		if f.peek().Typ != lex.ItemNumber {
-			return errorf("expected Number got %s: %s\n", lex.Rkey[f.token.Typ], f.token.Val)
-		}
-		f.next()
-		if !printIdentifier(f) {
-			return errorf("expected Identifier got %s: %s\n", lex.Rkey[f.token.Typ], f.token.Val)
-		}
-		if f.peek().Typ == lex.ItemRightBrace {
-			return format
-		}
-	case "}":
-		return format
+func setExit(code int) {
+	if code > exitCode {
+		exitCode = code
 	}
-	return formatEnumChar
 }
 
-func formatEnumChar(f *Formatter) stateFn {
-	if f.next().Val != "," {
-		return errorf("expected Comma got %s: %s\n", lex.Rkey[f.token.Typ], f.token.Val)
-	}
+func isWSFile(info os.FileInfo) bool {
+	name := info.Name()
+	return !info.IsDir() && !strings.HasPrefix(name, ".") && strings.HasSuffix(name, ".ws")
+}
 
-	f.Output.WriteString(",")
-	if f.peek().Typ == lex.ItemRightBrace {
-		return format
-	}
-	printNewline(f)
-	printTab(f)
-	return formatEnumIdent
+func walkDir(root string) {
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			report(err, exitError)
+			return nil
+		}
+		if info.IsDir() && path != root {
+			if s := settings(path); s != nil && s.Excluded != nil {
+				return filepath.SkipDir
+			}
+		}
+		if isWSFile(info) {
+			processPath(path, info)
+		}
+		return nil
+	})
 }
 
-func formatRightBrace(f *Formatter) stateFn {
-	f.scopeLevel = f.scopeLevel[:len(f.scopeLevel)-1]
-	if f.previousToken.Typ != lex.ItemLeftBrace {
-		f.Output.WriteString("\n")
-		printTab(f)
+// processPath formats the file at path unless a configuration file
+// excludes it.
+func processPath(path string, info os.FileInfo) {
+	s := settings(path)
+	if s == nil || s.Excluded != nil {
+		return
 	}
-	f.Output.WriteString("}")
-
-	switch f.peek().Typ {
-	case lex.ItemChar, lex.ItemElse, lex.ItemRightBrace:
-		return format
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		report(err, exitError)
+		return
 	}
-	return formatNewLine
+	processFile(path, src, info, s.Options)
 }
 
-func formatCase(f *Formatter) stateFn {
-	if !printIdentifier(f) {
-		return errorf("invalid identifier: trailing dot '.'")
-	}
-	switch f.next().Typ {
-	case lex.ItemLeftParen:
-		f.Output.WriteString(" (")
-		if f.next().Typ != lex.ItemIdentifier || !printIdentifier(f) {
-			return errorf("expected Identifier got %s: %s\n", lex.Rkey[f.token.Typ], f.token.Val)
-		}
-		if f.next().Typ != lex.ItemRightParen {
-			return errorf("expected parenthesis got %s: %s\n", lex.Rkey[f.token.Typ], f.token.Val)
-		}
-		f.Output.WriteString(")")
-		if f.next().Typ != lex.ItemIdentifier || !printIdentifier(f) {
-			return errorf("expected Identifier got %s: %s\n", lex.Rkey[f.token.Typ], f.token.Val)
+// processFile formats src, read from filename, and prints or writes the
+// result according to the flags. info is nil for standard input.
+func processFile(filename string, src []byte, info os.FileInfo, opts format.Options) {
+	opts.Filename = filename
+	var (
+		res []byte
+		err error
+	)
+	if firstLine > 0 {
+		res, err = format.Range(src, firstLine, lastLine, opts)
+	} else {
+		res, err = format.Source(src, opts)
+	}
+	if err != nil {
+		switch e := err.(type) {
+		case *format.FormatError:
+			reportSyntax(err, e.Pos, src, opts)
+		case *parser.Error:
+			reportSyntax(err, e.Pos, src, opts)
+		default:
+			report(err, exitError)
 		}
-	case lex.ItemIdentifier, lex.ItemNumber, lex.ItemString:
-		if !printIdentifier(f) {
-			return errorf("expected Identifier got %s: %s\n", lex.Rkey[f.token.Typ], f.token.Val)
+		return
+	}
+	if *verify {
+		check := format.Verify
+		if firstLine > 0 {
+			// the rest of the file is not formatted, so only the tokens can be checked
+			check = format.VerifyTokens
 		}
-	case lex.ItemOperator:
-		if (f.token.Val == "+" || f.token.Val == "-") && f.peek().Typ == lex.ItemNumber {
-			printOperator(f)
-			f.next()
-			if !printIdentifier(f) {
-				return errorf("expected Identifier got %s: %s\n", lex.Rkey[f.token.Typ], f.token.Val)
-			}
-		} else {
-			return errorf("Invalid Operator got %s: %s\n", lex.Rkey[f.token.Typ], f.token.Val)
+		if err := check(src, res, opts); err != nil {
+			report(err, exitVerify)
+			return
 		}
 	}
 
-	if f.next().Val != ":" {
-		return errorf("expected \":\" got %s: %s %s\n", lex.Rkey[f.token.Typ], f.token.Val, f.previousToken.Val)
+	if string(src) == string(res) {
+		if !*list && !*write && !*doDiff {
+			os.Stdout.Write(res)
+		}
+		return
 	}
-	f.Output.WriteString(":")
-	f.scopeLevel = append(f.scopeLevel, 1)
-	return formatNewLine
-}
 
-func formatArray(f *Formatter) stateFn {
-	if f.next().Val != "<" {
-		return errorf("expected \"<\" got %s: %s %s\n", lex.Rkey[f.token.Typ], f.token.Val, f.previousToken.Val)
-	}
-	f.Output.WriteString("array<")
-	switch f.next().Typ {
-	case lex.ItemIdentifier:
-		for {
-			f.Output.WriteString(f.token.Val)
-			if f.peek().Typ != lex.ItemDot {
-				break
-			}
-			f.next()
-			f.Output.WriteString(".")
-			if f.peek().Typ != lex.ItemIdentifier {
-				return errorf("expected Identifier got %s: %s\n", lex.Rkey[f.token.Typ], f.token.Val)
-			}
-			f.next()
+	if *list {
+		fmt.Println(filename)
+		setExit(exitUnformatted)
+	}
+	if *write {
+		if err := writeFile(filename, res, info.Mode().Perm()); err != nil {
+			report(err, exitError)
 		}
-	case lex.ItemArray:
-		return formatArray
-	default:
-		return errorf("Bad array syntax")
 	}
-	if f.next().Val != ">" {
-		return errorf("expected \">\" got %s: %s %s\n", lex.Rkey[f.token.Typ], f.token.Val, f.previousToken.Val)
+	if *doDiff {
+		a, _, _, _ := format.Decode(src)
+		b, _, _, _ := format.Decode(res)
+		if d := diff.Unified(filename+".orig", filename, a, b, 3); d != "" {
+			fmt.Print(d)
+		} else {
+			// only the encoding or line endings changed
+			fmt.Printf("--- %s.orig\n+++ %s\n(encoding or line endings differ)\n", filename, filename)
+		}
+		setExit(exitUnformatted)
 	}
-	for f.peek(); f.nextToken.Val == ">"; {
-		f.next()
-		f.Output.WriteString(">")
+	if !*list && !*write && !*doDiff {
+		os.Stdout.Write(res)
 	}
-	if f.peek().Typ == lex.ItemOperator && f.peek().Val != ">" {
-		f.Output.WriteString("> ")
-	} else {
-		f.Output.WriteString(">")
-	}
-	return format
 }
 
-func printTab(f *Formatter) {
-	for _, t := range f.scopeLevel {
-		for i := 0; i < t; i++ {
-			f.Output.WriteString("\t")
+// reportSyntax reports err, the syntax error at pos that stopped
+// formatting src, and the lexical errors after it.
+func reportSyntax(err error, pos lex.Position, src []byte, opts format.Options) {
+	report(err, exitSyntax)
+	errs, _ := format.LexErrors(src, opts)
+	for _, e := range errs {
+		if e.Pos.Offset > pos.Offset {
+			report(e, exitSyntax)
 		}
 	}
 }
 
-func isChar(t lex.ItemType) bool {
-	switch t {
-	case lex.ItemChar, lex.ItemLeftParen, lex.ItemRightParen, lex.ItemLeftBrace, lex.ItemRightBrace, lex.ItemDot:
-		return true
-	default:
-		return false
+// writeFile atomically replaces filename with data by writing a temporary
+// file in the same directory and renaming it over the original.
+func writeFile(filename string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".")
+	if err != nil {
+		return err
 	}
-}
-
-func printChar(f *Formatter) stateFn {
-	switch f.token.Val {
-	case ":", ",":
-		f.Output.WriteString(f.token.Val + " ")
-	case ";":
-		f.Output.WriteString(";")
-		if len(f.scopeLevel) > 0 {
-			f.scopeLevel[len(f.scopeLevel)-1] = 1
-		}
-		return formatNewLine
-	case "{":
-		f.Output.WriteString(" {")
-		f.scopeLevel = append(f.scopeLevel, 1)
-		return formatNewLine
-	case "}":
-		return formatRightBrace
-	case ".":
-		printDot(f)
-	default:
-		f.Output.WriteString(f.token.Val)
-	}
-	return format
-}
-
-func printNewline(f *Formatter) {
-	f.peek()
-	if f.nextToken.Typ != lex.ItemEOF {
-		for i := 0; i < f.newlineCount; i++ {
-			f.Output.WriteString("\n")
-		}
+	tmp := f.Name()
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp, filename)
+	}
+	if err != nil {
+		os.Remove(tmp)
 	}
+	return err
 }